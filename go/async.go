@@ -0,0 +1,140 @@
+package commonlog
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Asynchronous Delivery
+// ====================
+
+// ErrQueueFull is recorded for alerts dropped by DeliverAsync because its queue is full
+var ErrQueueFull = errors.New("commonlog: alert queue full")
+
+// ErrClosed is recorded for alerts passed to DeliverAsync after the Logger was closed
+var ErrClosed = errors.New("commonlog: logger closed")
+
+// defaultAsyncQueueSize is the number of alerts DeliverAsync buffers when AsyncQueueSize is unset
+const defaultAsyncQueueSize = 256
+
+// asyncDrainTimeout bounds how long Close keeps delivering queued alerts
+const asyncDrainTimeout = 5 * time.Second
+
+// asyncJob is an alert queued by DeliverAsync
+type asyncJob struct {
+	ctx     context.Context
+	logger  *Logger
+	alert   *types.Alert
+	channel string
+}
+
+// asyncQueue delivers queued alerts in order on a single worker, started by the first enqueue so
+// that Loggers which never call DeliverAsync hold no goroutine and need no Close
+type asyncQueue struct {
+	mu      sync.Mutex
+	jobs    chan asyncJob
+	started bool
+	closed  bool
+	ctx     context.Context // cancelled when Close gives up draining
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newAsyncQueue(size int) *asyncQueue {
+	if size <= 0 {
+		size = defaultAsyncQueueSize
+	}
+	q := &asyncQueue{jobs: make(chan asyncJob, size), done: make(chan struct{})}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	return q
+}
+
+// run delivers jobs until the queue is closed
+func (q *asyncQueue) run() {
+	defer close(q.done)
+	for job := range q.jobs {
+		ctx := detachedContext{Context: q.ctx, values: job.ctx}
+		if _, err := job.logger.Deliver(ctx, job.alert, job.channel); err != nil {
+			types.DebugLog(job.logger.config, "DeliverAsync: failed to deliver alert: %v", err)
+		}
+	}
+}
+
+// enqueue adds a job, starting the worker if needed, and reports ErrQueueFull or ErrClosed when it cannot
+func (q *asyncQueue) enqueue(job asyncJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if !q.started {
+		q.started = true
+		go q.run()
+	}
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close delivers the queued alerts, for at most asyncDrainTimeout, and stops the worker
+func (q *asyncQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.jobs)
+	started := q.started
+	q.mu.Unlock()
+
+	if started {
+		timer := time.AfterFunc(asyncDrainTimeout, q.cancel)
+		<-q.done
+		timer.Stop()
+	}
+	q.cancel()
+	return nil
+}
+
+// detachedContext keeps the values of the caller's context, such as trace IDs for the local sink,
+// while taking its deadline and cancellation from the queue
+type detachedContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// DeliverAsync queues an alert for delivery like Deliver and returns immediately, so that request
+// handlers and log calls never wait for the network or a rate limit. It reports whether the alert
+// was queued: alerts are dropped, and recorded in the local sink with ErrQueueFull, while
+// AsyncQueueSize alerts are waiting. An alert whose ctx is already done is not queued either, and is
+// recorded with the context's error, so integrations that alert about a request pass
+// context.WithoutCancel of its context to keep its values without its deadline.
+// Close delivers the queued alerts first.
+func (l *Logger) DeliverAsync(ctx context.Context, alert *types.Alert, channel string) bool {
+	if alert == nil {
+		return false
+	}
+	err := ctx.Err()
+	if err == nil {
+		err = l.resources.async.enqueue(asyncJob{ctx: ctx, logger: l, alert: alert, channel: channel})
+	}
+	if err != nil {
+		types.DebugLog(l.config, "DeliverAsync: dropped alert: %v", err)
+		l.logLocal(ctx, l.prepareAlert(alert), l.config.Provider, channel, false, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package commonlog
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Batching
+// ====================
+
+// Defaults for batching when BatchMaxLevel is set
+const (
+	defaultBatchInterval = time.Minute
+	defaultBatchSize     = 100
+)
+
+// maxDigestGroups bounds the groups listed in a batch digest
+const maxDigestGroups = 20
+
+// alertBatch is the buffer of one provider and channel
+type alertBatch struct {
+	alerts  []*types.Alert
+	started time.Time
+	timer   *time.Timer
+	flush   func(alerts []*types.Alert, started time.Time)
+}
+
+// batcher buffers alerts per provider and channel and sends them as one digest
+type batcher struct {
+	mu      sync.Mutex
+	batches map[string]*alertBatch
+}
+
+func newBatcher() *batcher {
+	return &batcher{batches: make(map[string]*alertBatch)}
+}
+
+// batchable reports whether an alert is buffered instead of sent. Alerts with attachments or a trace,
+// replies and updates are always sent on their own.
+func (l *Logger) batchable(alert *types.Alert, replace *types.MessageRef) bool {
+	return l.config.BatchMaxLevel > 0 && alert.Level <= l.config.BatchMaxLevel &&
+		alert.ThreadRef == nil && replace == nil && len(alert.Attachments) == 0 && alert.Trace == ""
+}
+
+// add buffers an alert for key. The first alert of a batch schedules its flush after interval; the
+// alert that fills the batch takes it, and the batch is returned for the caller to flush.
+func (b *batcher) add(key string, alert *types.Alert, interval time.Duration, size int,
+	flush func(alerts []*types.Alert, started time.Time)) (full []*types.Alert, started time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &alertBatch{started: time.Now(), flush: flush}
+		batch.timer = time.AfterFunc(interval, func() {
+			if alerts, started := b.take(key, batch); alerts != nil {
+				flush(alerts, started)
+			}
+		})
+		b.batches[key] = batch
+	}
+	batch.alerts = append(batch.alerts, alert)
+	if len(batch.alerts) < size {
+		return nil, time.Time{}
+	}
+	batch.timer.Stop()
+	delete(b.batches, key)
+	return batch.alerts, batch.started
+}
+
+// take removes batch if it is still pending for key and returns its alerts
+func (b *batcher) take(key string, batch *alertBatch) ([]*types.Alert, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.batches[key] != batch {
+		return nil, time.Time{}
+	}
+	delete(b.batches, key)
+	return batch.alerts, batch.started
+}
+
+// Close sends the digests of all pending batches
+func (b *batcher) Close() error {
+	b.mu.Lock()
+	batches := b.batches
+	b.batches = make(map[string]*alertBatch)
+	b.mu.Unlock()
+	for _, batch := range batches {
+		batch.timer.Stop()
+		batch.flush(batch.alerts, batch.started)
+	}
+	return nil
+}
+
+// digestGroup is a set of batched alerts sharing a fingerprint
+type digestGroup struct {
+	first *types.Alert
+	count int
+}
+
+// batchDigest combines batched alerts into one alert listing each fingerprint once with its count,
+// in order of first occurrence, at the highest level of the batch
+func (l *Logger) batchDigest(alerts []*types.Alert, started time.Time) *types.Alert {
+	var groups []*digestGroup
+	byFingerprint := make(map[string]*digestGroup)
+	digest := &types.Alert{Timestamp: time.Now()}
+	for _, alert := range alerts {
+		if alert.Level > digest.Level {
+			digest.Level = alert.Level
+		}
+		fingerprint := l.fingerprint(alert)
+		group, ok := byFingerprint[fingerprint]
+		if !ok {
+			group = &digestGroup{first: alert}
+			byFingerprint[fingerprint] = group
+			groups = append(groups, group)
+		}
+		group.count++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s in the last %s:\n", len(alerts), plural(int64(len(alerts)), "alert", "alerts"),
+		formatWindow(time.Since(started).Round(time.Second)))
+	for i, group := range groups {
+		if i == maxDigestGroups {
+			fmt.Fprintf(&b, "\n(and %d more)", len(groups)-i)
+			break
+		}
+		first, _, _ := strings.Cut(group.first.Message, "\n")
+		fmt.Fprintf(&b, "\n• %d× [%s] %s", group.count, group.first.Level, first)
+	}
+	digest.Message = b.String()
+	return digest
+}
@@ -0,0 +1,195 @@
+package commonlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Circuit Breaker
+// ====================
+
+// ErrCircuitOpen is matched by the CircuitOpenError returned for alerts to an endpoint whose circuit is open
+var ErrCircuitOpen = errors.New("commonlog: circuit open")
+
+// defaultOpenTimeout is how long a circuit stays open when OpenTimeout is unset
+const defaultOpenTimeout = 30 * time.Second
+
+// CircuitOpenError is returned, and recorded in the local sink, for alerts that failed fast
+type CircuitOpenError struct {
+	Endpoint string    // Provider endpoint whose circuit is open
+	Until    time.Time // When the next trial delivery is allowed
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("commonlog: circuit open for %s until %s", e.Endpoint, e.Until.Format(time.RFC3339))
+}
+
+// Unwrap lets errors.Is match ErrCircuitOpen
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// circuit is the breaker state of one endpoint
+type circuit struct {
+	state    types.CircuitState
+	failures int
+	until    time.Time // end of the open period
+	trial    bool      // a half-open trial delivery is in flight
+}
+
+// breakers keeps a circuit per provider endpoint, and the failover provider when one is configured
+type breakers struct {
+	mu             sync.Mutex
+	circuits       map[string]*circuit
+	failover       types.Provider
+	failoverConfig types.Config // CircuitBreaker.Failover with the Logger's defaults applied
+	failoverErr    error        // invalid HTTP options of the failover
+}
+
+// newBreakers creates the breakers of a Logger with config cfg. The failover defaults to the Logger's
+// service name, environment and HTTP client, and builds its own client when it sets HTTP options.
+func newBreakers(cfg types.Config) *breakers {
+	b := &breakers{circuits: make(map[string]*circuit)}
+	if cfg.CircuitBreaker.Failover == nil {
+		return b
+	}
+	failover := *cfg.CircuitBreaker.Failover
+	if failover.ServiceName == "" {
+		failover.ServiceName = cfg.ServiceName
+	}
+	if failover.Environment == "" {
+		failover.Environment = cfg.Environment
+	}
+	if reflect.ValueOf(failover.HTTP).IsZero() {
+		failover.HTTP.Client = cfg.HTTP.Client
+	} else if failover.HTTP.Client == nil {
+		client, err := failover.HTTP.NewClient()
+		if err != nil {
+			fmt.Printf("[commonlog] Warning: invalid failover HTTP options, failover alerts are only logged locally: %v\n", err)
+			b.failoverErr = fmt.Errorf("invalid failover HTTP options: %w", err)
+		}
+		failover.HTTP.Client = client
+	}
+	b.failover = createProvider(failover.Provider)
+	b.failoverConfig = failover
+	return b
+}
+
+// Close releases the failover provider
+func (b *breakers) Close() error {
+	if closer, ok := b.failover.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// circuitEndpoint names the endpoint a delivery goes to: the webhook host for webhooks and the
+// generic provider, and the provider's API otherwise
+func circuitEndpoint(providerName string, cfg types.Config) string {
+	if providerName == "generic" || cfg.SendMethod == types.MethodWebhook {
+		if u, err := url.Parse(cfg.Token); err == nil && u.Host != "" {
+			return providerName + ":" + u.Host
+		}
+		return providerName + ":webhook"
+	}
+	return providerName + ":api"
+}
+
+// allowDelivery reports whether a delivery to endpoint may proceed. An open circuit whose timeout has
+// passed turns half-open and allows a single trial delivery.
+func (l *Logger) allowDelivery(endpoint string) error {
+	b := l.resources.breakers
+	b.mu.Lock()
+	c, ok := b.circuits[endpoint]
+	if !ok {
+		c = &circuit{}
+		b.circuits[endpoint] = c
+	}
+	switch c.state {
+	case types.CircuitOpen:
+		if time.Now().Before(c.until) {
+			b.mu.Unlock()
+			return &CircuitOpenError{Endpoint: endpoint, Until: c.until}
+		}
+		c.state, c.trial = types.CircuitHalfOpen, true
+		b.mu.Unlock()
+		l.circuitChanged(endpoint, types.CircuitOpen, types.CircuitHalfOpen)
+		return nil
+	case types.CircuitHalfOpen:
+		if c.trial {
+			until := c.until
+			b.mu.Unlock()
+			return &CircuitOpenError{Endpoint: endpoint, Until: until}
+		}
+		c.trial = true
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// recordDelivery updates the circuit of endpoint with the outcome of a delivery, where err is a transient
+// failure or nil. Deliveries abandoned by the caller's context do not count as failures.
+func (l *Logger) recordDelivery(ctx context.Context, endpoint string, err error) {
+	b := l.resources.breakers
+	cfg := l.config.CircuitBreaker
+	b.mu.Lock()
+	c := b.circuits[endpoint]
+	from := c.state
+	c.trial = false
+	if err != nil && ctx.Err() != nil {
+		b.mu.Unlock()
+		return
+	}
+	if err == nil {
+		c.state, c.failures = types.CircuitClosed, 0
+	} else {
+		c.failures++
+		if c.state == types.CircuitHalfOpen || c.failures >= cfg.FailureThreshold {
+			timeout := cfg.OpenTimeout
+			if timeout <= 0 {
+				timeout = defaultOpenTimeout
+			}
+			c.state, c.until = types.CircuitOpen, time.Now().Add(timeout)
+		}
+	}
+	to := c.state
+	b.mu.Unlock()
+	if from != to {
+		l.circuitChanged(endpoint, from, to)
+	}
+}
+
+// circuitChanged reports a state change to the debug log and the OnStateChange hook
+func (l *Logger) circuitChanged(endpoint string, from, to types.CircuitState) {
+	types.DebugLog(l.config, "circuit breaker: %s changed from %s to %s", endpoint, from, to)
+	if hook := l.config.CircuitBreaker.OnStateChange; hook != nil {
+		hook(endpoint, from, to)
+	}
+}
+
+// failoverAlert delivers an alert that failed fast to CircuitBreaker.Failover. Thread references do
+// not carry over to the failover.
+func (l *Logger) failoverAlert(ctx context.Context, alert *types.Alert) (*types.DeliveryResult, error) {
+	b := l.resources.breakers
+	cfg := b.failoverConfig
+	failover := *alert
+	failover.ThreadRef = nil
+	if b.failoverErr != nil {
+		l.logLocal(ctx, &failover, cfg.Provider, cfg.Channel, false, b.failoverErr)
+		return nil, b.failoverErr
+	}
+	types.DebugLog(l.config, "circuit breaker: failing over to %s channel %s", cfg.Provider, cfg.Channel)
+
+	result, err := b.failover.Deliver(ctx, &failover, types.Target{Channel: cfg.Channel, Config: cfg})
+	l.logLocal(ctx, &failover, cfg.Provider, cfg.Channel, true, err)
+	return result, err
+}
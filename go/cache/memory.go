@@ -0,0 +1,118 @@
+// Package cache provides the built-in types.Cache backends used for Lark tokens and chat IDs,
+// which also implement types.Counter for deduplication.
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often writes also remove expired entries, so that keys that are never
+// read again do not accumulate
+const memorySweepInterval = time.Minute
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time // zero means no expiry
+}
+
+// Memory is an in-process TTL cache. It is safe for concurrent use. Expired entries are removed when
+// read, and by a sweep on writes at most once a minute.
+type Memory struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+// NewMemory creates an empty in-process cache
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]memoryEntry), lastSweep: time.Now()}
+}
+
+// sweep removes expired entries at most once per memorySweepInterval. The caller holds m.mu.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, entry := range m.entries {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// Get returns the cached value and whether it was found and not expired
+func (m *Memory) Get(ctx context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Set stores a value; a ttl of zero means no expiry
+func (m *Memory) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	m.mu.Lock()
+	m.sweep(time.Now())
+	m.entries[key] = entry
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete removes a value
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// Incr increments the counter at key; ttl is applied when the counter is created
+func (m *Memory) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(time.Now())
+	entry, ok := m.entries[key]
+	if ok && !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		ok = false
+	}
+	var n int64
+	if ok {
+		n, _ = strconv.ParseInt(entry.value, 10, 64)
+	} else {
+		entry = memoryEntry{}
+		if ttl > 0 {
+			entry.expiresAt = time.Now().Add(ttl)
+		}
+	}
+	n++
+	entry.value = strconv.FormatInt(n, 10)
+	m.entries[key] = entry
+	return n, nil
+}
+
+// Take returns the counter at key and deletes it
+func (m *Memory) Take(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	delete(m.entries, key)
+	if !ok || (!entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt)) {
+		return 0, nil
+	}
+	n, _ := strconv.ParseInt(entry.value, 10, 64)
+	return n, nil
+}
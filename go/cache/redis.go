@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// Redis is a cache backed by a Redis server, allowing tokens and chat IDs to be shared across replicas.
+// It holds a single client for its lifetime; call Close to release it.
+type Redis struct {
+	client redis.UniversalClient
+	owned  bool
+}
+
+// NewRedis wraps an existing client. The client is not closed by Close.
+func NewRedis(client redis.UniversalClient) *Redis {
+	return &Redis{client: client}
+}
+
+// NewRedisFromOptions creates a client from opts, selecting a single node, Sentinel or Cluster
+// client as described by redis.NewUniversalClient. The client is closed by Close.
+func NewRedisFromOptions(opts *redis.UniversalOptions) *Redis {
+	return &Redis{client: redis.NewUniversalClient(opts), owned: true}
+}
+
+// Get returns the cached value and whether it was found
+func (r *Redis) Get(ctx context.Context, key string) (string, bool, error) {
+	result, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return result, true, nil
+}
+
+// Set stores a value; a ttl of zero means no expiry
+func (r *Redis) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+// Delete removes a value
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, key).Err()
+}
+
+// incrScript increments a counter and sets its ttl in one step, so that a counter is never left
+// without an expiry. Counters that lost theirs are given one again.
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if tonumber(ARGV[1]) > 0 and redis.call("PTTL", KEYS[1]) < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// Incr increments the counter at key; ttl is applied when the counter is created
+func (r *Redis) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return incrScript.Run(ctx, r.client, []string{key}, ttl.Milliseconds()).Int64()
+}
+
+// Take returns the counter at key and deletes it, atomically in a transaction
+func (r *Redis) Take(ctx context.Context, key string) (int64, error) {
+	var get *redis.StringCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return get.Int64()
+}
+
+// Close closes the underlying client if it was created by NewRedisFromOptions
+func (r *Redis) Close() error {
+	if !r.owned {
+		return nil
+	}
+	return r.client.Close()
+}
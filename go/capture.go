@@ -0,0 +1,149 @@
+package commonlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Error and Panic Capture
+// ====================
+
+// maxStackFrames bounds the number of frames captured for a trace
+const maxStackFrames = 64
+
+// modulePrefix is the import path of this module, used to trim its own frames from captured stacks
+var modulePrefix = strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(NewLogger).Pointer()).Name(), ".NewLogger")
+
+// SendError sends an ERROR alert for err. The message is "message: err", or just the error when
+// message is empty, and the trace holds the error chain and the caller's stack.
+func (l *Logger) SendError(ctx context.Context, err error, message string) error {
+	if err == nil {
+		return nil
+	}
+	if message == "" {
+		message = err.Error()
+	} else {
+		message += ": " + err.Error()
+	}
+	alert := l.newAlert(types.ERROR, message, nil, l.CaptureTrace(types.ERROR, err))
+	_, sendErr := l.Deliver(ctx, alert, "")
+	return sendErr
+}
+
+// Recover recovers a panic and reports it as a FATAL alert carrying the panic value and the stack of
+// the panicking goroutine, then returns normally. It must be deferred directly:
+//
+//	defer logger.Recover()
+func (l *Logger) Recover() {
+	value := recover()
+	if value == nil {
+		return
+	}
+	l.sendPanic(context.Background(), types.FATAL, value, nil)
+}
+
+// sendPanic reports a recovered panic value at level with optional fields
+func (l *Logger) sendPanic(ctx context.Context, level types.Level, value interface{}, fields map[string]interface{}) error {
+	err, _ := value.(error)
+	alert := l.newAlert(level, fmt.Sprintf("panic: %v", value), nil, l.CaptureTrace(level, err))
+	alert.Fields = fields
+	_, sendErr := l.Deliver(ctx, alert, "")
+	if sendErr != nil {
+		types.DebugLog(l.config, "sendPanic: failed to send alert: %v", sendErr)
+	}
+	return sendErr
+}
+
+// CaptureTrace builds the trace used by SendError and Recover: the error chain of err, if any, and the
+// current goroutine's stack without frames from this module and the runtime. At FATAL with
+// DumpAllGoroutines set, the stacks of all goroutines are appended. Call it from a deferred function
+// to capture the stack of a panic.
+func (l *Logger) CaptureTrace(level types.Level, err error) string {
+	var b strings.Builder
+	if err != nil {
+		b.WriteString("Error chain:\n")
+		writeErrorChain(&b, err, 0)
+		b.WriteString("\n")
+	}
+	b.WriteString(callerStack())
+	if level == types.FATAL && l.config.DumpAllGoroutines {
+		b.WriteString("\n--- All goroutines ---\n")
+		b.Write(allGoroutines())
+	}
+	return b.String()
+}
+
+// writeErrorChain writes err and everything it wraps, one error per line, with joined errors
+// indented under the error that joins them
+func writeErrorChain(b *strings.Builder, err error, depth int) {
+	for err != nil {
+		fmt.Fprintf(b, "%s%T: %v\n", strings.Repeat("  ", depth), err, err)
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, e := range joined.Unwrap() {
+				writeErrorChain(b, e, depth+1)
+			}
+			return
+		}
+		err = errors.Unwrap(err)
+		depth++
+	}
+}
+
+// callerStack formats the current goroutine's stack in the style of runtime.Stack, starting at the
+// first frame outside this module and the runtime
+func callerStack() string {
+	pcs := make([]uintptr, maxStackFrames)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+	b.WriteString(goroutineHeader())
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame) {
+			fmt.Fprintf(&b, "%s()\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// isInternalFrame reports whether a frame belongs to this module (outside its tests) or the runtime
+func isInternalFrame(frame runtime.Frame) bool {
+	if strings.HasPrefix(frame.Function, "runtime.") {
+		return true
+	}
+	if strings.HasSuffix(frame.File, "_test.go") {
+		return false
+	}
+	return strings.HasPrefix(frame.Function, modulePrefix+".") || strings.HasPrefix(frame.Function, modulePrefix+"/")
+}
+
+// goroutineHeader returns the "goroutine N [status]:" line of the current goroutine
+func goroutineHeader() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	header, _, _ := strings.Cut(string(buf), "\n")
+	return header + "\n"
+}
+
+// allGoroutines returns the stacks of all goroutines, growing the buffer until they fit
+func allGoroutines() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,375 @@
+package commonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alvianhanif/commonlog/go/types"
+	"gopkg.in/yaml.v3"
+)
+
+// ====================
+// Configuration Files
+// ====================
+
+// FileConfig is the layout of a YAML or JSON configuration file. Settings in Defaults apply to every
+// destination that does not set them itself.
+type FileConfig struct {
+	Defaults     DestinationConfig            `yaml:"defaults" json:"defaults"`
+	Destinations map[string]DestinationConfig `yaml:"destinations" json:"destinations"`
+	Routes       []RouteConfig                `yaml:"routes" json:"routes"` // Without routes, every destination receives every level
+}
+
+// DestinationConfig describes one named alert destination
+type DestinationConfig struct {
+	Provider        string            `yaml:"provider" json:"provider"`
+	SendMethod      string            `yaml:"send_method" json:"send_method"` // "webclient" (default) or "webhook"
+	Token           string            `yaml:"token" json:"token"`
+	SlackToken      string            `yaml:"slack_token" json:"slack_token"`
+	LarkAppID       string            `yaml:"lark_app_id" json:"lark_app_id"`
+	LarkAppSecret   string            `yaml:"lark_app_secret" json:"lark_app_secret"`
+	LarkDomain      string            `yaml:"lark_domain" json:"lark_domain"` // "lark", "feishu" or a base URL
+	Channel         string            `yaml:"channel" json:"channel"`
+	Channels        map[string]string `yaml:"channels" json:"channels"` // Channel per level, e.g. CRITICAL: oncall
+	ServiceName     string            `yaml:"service_name" json:"service_name"`
+	Environment     string            `yaml:"environment" json:"environment"`
+	MinRemoteLevel  string            `yaml:"min_remote_level" json:"min_remote_level"`
+	RedisAddrs      []string          `yaml:"redis_addrs" json:"redis_addrs"`
+	RedisMasterName string            `yaml:"redis_master_name" json:"redis_master_name"`
+	RedisUsername   string            `yaml:"redis_username" json:"redis_username"`
+	RedisPassword   string            `yaml:"redis_password" json:"redis_password"`
+	RedisDB         int               `yaml:"redis_db" json:"redis_db"`
+	Debug           bool              `yaml:"debug" json:"debug"`
+}
+
+// RouteConfig sends alerts of the given levels to destinations
+type RouteConfig struct {
+	Levels       []string `yaml:"levels" json:"levels"`             // Levels routed, e.g. [ERROR, CRITICAL]
+	MinLevel     string   `yaml:"min_level" json:"min_level"`       // Or every level from this one up
+	Destinations []string `yaml:"destinations" json:"destinations"` // Names of the destinations
+}
+
+// interpolation matches ${NAME} and ${NAME:-default}
+var interpolation = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ParseConfigFile parses a YAML or JSON configuration file. ${NAME} in values is replaced with the
+// environment variable NAME, or with the default in ${NAME:-default}, and a value of the form
+// file:///path is replaced with the trimmed content of that file.
+func ParseConfigFile(data []byte) (*FileConfig, error) {
+	var root yaml.Node
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		// JSON is parsed as such, since YAML rejects the tab indentation JSON often has
+		var value interface{}
+		if err := json.Unmarshal(trimmed, &value); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if err := root.Encode(value); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	} else if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	var problems types.ConfigError
+	resolveNode(&root, &problems)
+	if len(problems.Missing) > 0 || len(problems.Invalid) > 0 {
+		return nil, &problems
+	}
+
+	var file FileConfig
+	if err := root.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return &file, nil
+}
+
+// resolveNode interpolates environment variables and file references in the values under node
+func resolveNode(node *yaml.Node, problems *types.ConfigError) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			resolveNode(child, problems)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			resolveNode(node.Content[i], problems)
+		}
+	case yaml.ScalarNode:
+		value := interpolation.ReplaceAllStringFunc(node.Value, func(match string) string {
+			groups := interpolation.FindStringSubmatch(match)
+			if env, ok := os.LookupEnv(groups[1]); ok {
+				return env
+			}
+			if groups[2] == "" {
+				problems.Missing = append(problems.Missing, "${"+groups[1]+"}")
+			}
+			return groups[3]
+		})
+		if path := strings.TrimPrefix(value, "file://"); path != value {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				problems.Invalid = append(problems.Invalid, value+": "+err.Error())
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+		if value != node.Value {
+			// Resolve the type again, so that interpolated numbers and booleans decode as such
+			node.Value, node.Tag, node.Style = value, "", 0
+		}
+	}
+}
+
+// Configs returns the validated Config of every destination, with defaults applied. Every problem
+// is reported in a *types.ConfigError, with keys such as "destinations.oncall.Token".
+func (f *FileConfig) Configs() (map[string]types.Config, error) {
+	var problems types.ConfigError
+	if len(f.Destinations) == 0 {
+		problems.Missing = append(problems.Missing, "destinations")
+	}
+	configs := make(map[string]types.Config, len(f.Destinations))
+	for name, destination := range f.Destinations {
+		prefix := "destinations." + name + "."
+		cfg, invalid := f.Defaults.merge(destination).config()
+		for _, problem := range invalid {
+			problems.Invalid = append(problems.Invalid, prefix+problem)
+		}
+		var cfgErr *types.ConfigError
+		if errors.As(cfg.Validate(), &cfgErr) {
+			for _, key := range cfgErr.Missing {
+				problems.Missing = append(problems.Missing, prefix+key)
+			}
+			for _, problem := range cfgErr.Invalid {
+				problems.Invalid = append(problems.Invalid, prefix+problem)
+			}
+		}
+		configs[name] = cfg
+	}
+	for i, route := range f.Routes {
+		prefix := fmt.Sprintf("routes[%d].", i)
+		if len(route.Destinations) == 0 {
+			problems.Missing = append(problems.Missing, prefix+"destinations")
+		}
+		for _, name := range route.Destinations {
+			if _, ok := f.Destinations[name]; !ok {
+				problems.Invalid = append(problems.Invalid, fmt.Sprintf("%sdestinations: unknown destination %q", prefix, name))
+			}
+		}
+		if _, err := route.levels(); err != nil {
+			problems.Invalid = append(problems.Invalid, prefix+err.Error())
+		}
+	}
+	sort.Strings(problems.Missing)
+	sort.Strings(problems.Invalid)
+	if len(problems.Missing) > 0 || len(problems.Invalid) > 0 {
+		return configs, &problems
+	}
+	return configs, nil
+}
+
+// merge returns d with unset settings taken from defaults
+func (defaults DestinationConfig) merge(d DestinationConfig) DestinationConfig {
+	for _, field := range []struct{ value, fallback *string }{
+		{&d.Provider, &defaults.Provider},
+		{&d.SendMethod, &defaults.SendMethod},
+		{&d.Token, &defaults.Token},
+		{&d.SlackToken, &defaults.SlackToken},
+		{&d.LarkAppID, &defaults.LarkAppID},
+		{&d.LarkAppSecret, &defaults.LarkAppSecret},
+		{&d.LarkDomain, &defaults.LarkDomain},
+		{&d.Channel, &defaults.Channel},
+		{&d.ServiceName, &defaults.ServiceName},
+		{&d.Environment, &defaults.Environment},
+		{&d.MinRemoteLevel, &defaults.MinRemoteLevel},
+		{&d.RedisMasterName, &defaults.RedisMasterName},
+		{&d.RedisUsername, &defaults.RedisUsername},
+		{&d.RedisPassword, &defaults.RedisPassword},
+	} {
+		if *field.value == "" {
+			*field.value = *field.fallback
+		}
+	}
+	if d.Channels == nil {
+		d.Channels = defaults.Channels
+	}
+	if d.RedisAddrs == nil {
+		d.RedisAddrs = defaults.RedisAddrs
+	}
+	if d.RedisDB == 0 {
+		d.RedisDB = defaults.RedisDB
+	}
+	d.Debug = d.Debug || defaults.Debug
+	return d
+}
+
+// config converts a destination to a Config, returning the settings that could not be converted
+func (d DestinationConfig) config() (types.Config, []string) {
+	var invalid []string
+	cfg := types.Config{
+		Provider:    strings.ToLower(d.Provider),
+		SendMethod:  strings.ToLower(d.SendMethod),
+		Token:       d.Token,
+		SlackToken:  d.SlackToken,
+		LarkToken:   types.LarkTokenConfig{AppID: d.LarkAppID, AppSecret: d.LarkAppSecret},
+		Channel:     d.Channel,
+		ServiceName: d.ServiceName,
+		Environment: d.Environment,
+		Redis: types.RedisConfig{
+			Addrs:      d.RedisAddrs,
+			MasterName: d.RedisMasterName,
+			Username:   d.RedisUsername,
+			Password:   d.RedisPassword,
+			DB:         d.RedisDB,
+		},
+		Debug: d.Debug,
+	}
+	if cfg.SendMethod == "" {
+		cfg.SendMethod = types.MethodWebClient
+	}
+	if domain, ok := larkDomain(d.LarkDomain); ok {
+		cfg.LarkToken.Domain = domain
+	} else {
+		invalid = append(invalid, fmt.Sprintf("lark_domain: %q is not lark, feishu or a URL", d.LarkDomain))
+	}
+	if d.MinRemoteLevel != "" {
+		level, err := types.ParseLevel(d.MinRemoteLevel)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("min_remote_level: %q is not a level", d.MinRemoteLevel))
+		}
+		cfg.MinRemoteLevel = level
+	}
+	if len(d.Channels) > 0 {
+		channels := make(map[types.Level]string, len(d.Channels))
+		for name, channel := range d.Channels {
+			level, err := types.ParseLevel(name)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("channels: %q is not a level", name))
+				continue
+			}
+			channels[level] = channel
+		}
+		cfg.ChannelResolver = &types.DefaultChannelResolver{ChannelMap: channels, DefaultChannel: cfg.Channel}
+	}
+	return cfg, invalid
+}
+
+// levels returns the levels matched by a route, keyed by level
+func (r RouteConfig) levels() (map[types.Level]bool, error) {
+	levels := make(map[types.Level]bool)
+	for _, name := range r.Levels {
+		level, err := types.ParseLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("levels: %q is not a level", name)
+		}
+		levels[level] = true
+	}
+	if r.MinLevel != "" {
+		min, err := types.ParseLevel(r.MinLevel)
+		if err != nil {
+			return nil, fmt.Errorf("min_level: %q is not a level", r.MinLevel)
+		}
+		for level := min; level <= types.FATAL; level++ {
+			levels[level] = true
+		}
+	}
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("levels or min_level is required")
+	}
+	return levels, nil
+}
+
+// Router sends alerts to the named destinations of a configuration file, routed by level
+type Router struct {
+	loggers map[string]*Logger
+	routes  map[types.Level][]*Logger
+}
+
+// LoadConfigFile builds a Router from a YAML or JSON configuration file (see ParseConfigFile)
+func LoadConfigFile(path string) (*Router, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return LoadConfig(data)
+}
+
+// LoadConfig builds a Router from YAML or JSON configuration, creating a Logger per destination
+func LoadConfig(data []byte) (*Router, error) {
+	file, err := ParseConfigFile(data)
+	if err != nil {
+		return nil, err
+	}
+	configs, err := file.Configs()
+	if err != nil {
+		return nil, err
+	}
+
+	router := &Router{loggers: make(map[string]*Logger, len(configs)), routes: make(map[types.Level][]*Logger)}
+	names := make([]string, 0, len(configs))
+	for name, cfg := range configs {
+		router.loggers[name] = NewLogger(cfg)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	routes := file.Routes
+	if len(routes) == 0 {
+		routes = []RouteConfig{{MinLevel: types.DEBUG.String(), Destinations: names}}
+	}
+	for _, route := range routes {
+		levels, _ := route.levels()
+		for level := range levels {
+			for _, name := range route.Destinations {
+				router.routes[level] = appendLogger(router.routes[level], router.loggers[name])
+			}
+		}
+	}
+	return router, nil
+}
+
+// appendLogger appends logger unless a route already sends to it
+func appendLogger(loggers []*Logger, logger *Logger) []*Logger {
+	for _, l := range loggers {
+		if l == logger {
+			return loggers
+		}
+	}
+	return append(loggers, logger)
+}
+
+// Logger returns the Logger of a named destination, or nil if there is none
+func (r *Router) Logger(name string) *Logger {
+	return r.loggers[name]
+}
+
+// Send sends an alert to every destination routed for its level
+func (r *Router) Send(level types.Level, message string, attachment *types.Attachment, trace string) error {
+	loggers := r.routes[level]
+	if attachment != nil && len(loggers) > 1 {
+		// Read a Reader once, so that every destination receives the content
+		if loaded, err := attachment.Load(); err == nil {
+			attachment = &loaded
+		}
+	}
+	var errs []error
+	for _, logger := range loggers {
+		if err := logger.Send(level, message, attachment, trace); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the Logger of every destination
+func (r *Router) Close() error {
+	var errs []error
+	for _, logger := range r.loggers {
+		if err := logger.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
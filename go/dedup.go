@@ -0,0 +1,173 @@
+package commonlog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/cache"
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Deduplication
+// ====================
+
+// Variable parts of messages, replaced to derive the message template used in fingerprints
+var (
+	uuidPattern   = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	hexPattern    = regexp.MustCompile(`(?i)\b(?:0x)?[0-9a-f]*[0-9][0-9a-f]*\b`)
+	numberPattern = regexp.MustCompile(`\d+`)
+)
+
+// MessageTemplate returns message with UUIDs, hex identifiers and numbers replaced by placeholders,
+// so that alerts differing only in such values share a fingerprint
+func MessageTemplate(message string) string {
+	message = uuidPattern.ReplaceAllString(message, "<uuid>")
+	message = hexPattern.ReplaceAllStringFunc(message, func(s string) string {
+		if len(s) >= 8 {
+			return "<hex>"
+		}
+		return s
+	})
+	return numberPattern.ReplaceAllString(message, "<n>")
+}
+
+// DefaultFingerprint identifies repeats of an alert: its DedupKey if set, otherwise a hash of the
+// level, service and message template
+func DefaultFingerprint(alert *types.Alert, cfg types.Config) string {
+	if alert.DedupKey != "" {
+		return alert.DedupKey
+	}
+	sum := sha256.Sum256([]byte(alert.Level.String() + "\x00" + cfg.ServiceName + "\x00" + MessageTemplate(alert.Message)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// fingerprint identifies repeats of an alert with DedupFingerprint, or DefaultFingerprint
+func (l *Logger) fingerprint(alert *types.Alert) string {
+	if l.config.DedupFingerprint != nil {
+		return l.config.DedupFingerprint(alert)
+	}
+	return DefaultFingerprint(alert, l.config)
+}
+
+// deduper suppresses repeats of an alert within a window and sends a digest of the suppressed
+// repeats when the window closes. The replica that opened a window sends its digest.
+type deduper struct {
+	store   types.Counter
+	mu      sync.Mutex
+	pending map[*time.Timer]func() // digest timers, fired early by Close
+}
+
+func newDeduper(store types.Counter) *deduper {
+	if store == nil {
+		store = cache.NewMemory()
+	}
+	return &deduper{store: store, pending: make(map[*time.Timer]func())}
+}
+
+// dedupKey returns the store key of a fingerprint's window marker or repeat counter
+func dedupKey(cfg types.Config, kind, fingerprint string) string {
+	prefix := cfg.CacheKeyPrefix
+	if prefix == "" {
+		prefix = "commonlog"
+	}
+	return prefix + ":dedup:" + kind + ":" + fingerprint
+}
+
+// admit reports whether an alert to a provider's channel should be sent. The first occurrence opens a
+// window and is sent; repeats within the window are counted and suppressed. Windows are kept per
+// provider and channel, so that each channel gets its own digest. Store errors admit the alert.
+func (d *deduper) admit(ctx context.Context, l *Logger, providerName, channel string, alert *types.Alert, digest func(count int64)) bool {
+	cfg := l.config
+	fingerprint := providerName + ":" + channel + ":" + l.fingerprint(alert)
+	window := cfg.DedupWindow
+
+	opened, err := d.store.Incr(ctx, dedupKey(cfg, "window", fingerprint), window)
+	if err != nil {
+		types.DebugLog(cfg, "dedup: store unavailable, sending alert: %v", err)
+		return true
+	}
+	countKey := dedupKey(cfg, "count", fingerprint)
+	if opened > 1 {
+		// Keep the counter past the window so that the digest can still take it
+		if _, err := d.store.Incr(ctx, countKey, 2*window); err != nil {
+			types.DebugLog(cfg, "dedup: failed to count repeat: %v", err)
+		}
+		types.DebugLog(cfg, "dedup: suppressed repeat of %s", fingerprint)
+		return false
+	}
+
+	var timer *time.Timer
+	fire := func() {
+		count, err := d.store.Take(context.Background(), countKey)
+		if err != nil {
+			types.DebugLog(cfg, "dedup: failed to read repeat count: %v", err)
+			return
+		}
+		if count > 0 {
+			digest(count)
+		}
+	}
+	d.mu.Lock()
+	timer = time.AfterFunc(window, func() {
+		d.mu.Lock()
+		_, ok := d.pending[timer]
+		delete(d.pending, timer)
+		d.mu.Unlock()
+		if ok {
+			fire()
+		}
+	})
+	d.pending[timer] = fire
+	d.mu.Unlock()
+	return true
+}
+
+// Close sends the digests of open windows immediately
+func (d *deduper) Close() error {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[*time.Timer]func())
+	d.mu.Unlock()
+	for timer, fire := range pending {
+		if timer.Stop() {
+			fire()
+		}
+	}
+	return nil
+}
+
+// digestAlert builds the digest sent when a window with suppressed repeats closes
+func digestAlert(alert *types.Alert, count int64, window time.Duration) *types.Alert {
+	digest := *alert
+	digest.Attachments = nil
+	digest.Trace = ""
+	digest.Timestamp = time.Now()
+	digest.Message = fmt.Sprintf("%s\n\nThis occurred %d more %s in the last %s", alert.Message, count, plural(count, "time", "times"), formatWindow(window))
+	return &digest
+}
+
+// formatWindow formats a duration without trailing zero units, e.g. "5m" instead of "5m0s"
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func plural(n int64, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
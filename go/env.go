@@ -0,0 +1,229 @@
+package commonlog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Environment
+// ====================
+
+// DefaultEnvPrefix is the prefix of the environment variables read by ConfigFromEnv
+const DefaultEnvPrefix = "COMMONLOG"
+
+// envReader reads prefixed environment variables and collects every problem with them
+type envReader struct {
+	prefix string
+	err    types.ConfigError
+}
+
+func (r *envReader) key(name string) string {
+	return r.prefix + "_" + name
+}
+
+// get returns the trimmed value of a variable, empty when unset
+func (r *envReader) get(name string) string {
+	return strings.TrimSpace(os.Getenv(r.key(name)))
+}
+
+func (r *envReader) invalid(name string, format string, args ...interface{}) {
+	r.err.Invalid = append(r.err.Invalid, r.key(name)+": "+fmt.Sprintf(format, args...))
+}
+
+func (r *envReader) bool(name string) bool {
+	value := r.get(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.invalid(name, "%q is not a boolean", value)
+	}
+	return b
+}
+
+func (r *envReader) int(name string) int {
+	value := r.get(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		r.invalid(name, "%q is not an integer", value)
+	}
+	return n
+}
+
+func (r *envReader) level(name string) types.Level {
+	value := r.get(name)
+	if value == "" {
+		return 0
+	}
+	level, err := types.ParseLevel(value)
+	if err != nil {
+		r.invalid(name, "%q is not a level", value)
+	}
+	return level
+}
+
+// ConfigFromEnv builds a Config from environment variables named <prefix>_<KEY>, with prefix
+// defaulting to DefaultEnvPrefix:
+//
+//	PROVIDER                  "slack", "lark" or "generic" (required)
+//	SEND_METHOD               "webclient" (default) or "webhook"
+//	TOKEN, SLACK_TOKEN        API token, or webhook URL for webhooks and the generic provider
+//	LARK_APP_ID, LARK_APP_SECRET, LARK_DOMAIN ("lark", "feishu" or a base URL)
+//	CHANNEL                   Default channel
+//	CHANNEL_<LEVEL>           Channel for one level, e.g. COMMONLOG_CHANNEL_ERROR
+//	SERVICE_NAME, ENVIRONMENT
+//	MIN_REMOTE_LEVEL          Lowest level sent to the provider
+//	REDIS_ADDRS               Comma-separated host:port addresses, or REDIS_HOST and REDIS_PORT
+//	REDIS_MASTER_NAME, REDIS_USERNAME, REDIS_PASSWORD, REDIS_DB
+//	DEBUG                     Enable debug logging
+//
+// Every missing or invalid variable is reported in a *types.ConfigError, including the problems
+// found by Config.Validate, under the names of the variables.
+func ConfigFromEnv(prefix string) (types.Config, error) {
+	prefix = strings.TrimSuffix(prefix, "_")
+	if prefix == "" {
+		prefix = DefaultEnvPrefix
+	}
+	r := &envReader{prefix: prefix}
+	cfg := types.Config{
+		Provider:    strings.ToLower(r.get("PROVIDER")),
+		SendMethod:  strings.ToLower(r.get("SEND_METHOD")),
+		Token:       r.get("TOKEN"),
+		SlackToken:  r.get("SLACK_TOKEN"),
+		Channel:     r.get("CHANNEL"),
+		ServiceName: r.get("SERVICE_NAME"),
+		Environment: r.get("ENVIRONMENT"),
+		LarkToken: types.LarkTokenConfig{
+			AppID:     r.get("LARK_APP_ID"),
+			AppSecret: r.get("LARK_APP_SECRET"),
+		},
+		MinRemoteLevel: r.level("MIN_REMOTE_LEVEL"),
+		Debug:          r.bool("DEBUG"),
+	}
+	if cfg.SendMethod == "" {
+		cfg.SendMethod = types.MethodWebClient
+	}
+
+	if domain, ok := larkDomain(r.get("LARK_DOMAIN")); ok {
+		cfg.LarkToken.Domain = domain
+	} else {
+		r.invalid("LARK_DOMAIN", "%q is not lark, feishu or a URL", r.get("LARK_DOMAIN"))
+	}
+
+	r.readChannelMap(&cfg)
+	r.readRedis(&cfg)
+
+	// The provider, send method and credentials are checked by Validate, under the variable names
+	var cfgErr *types.ConfigError
+	if errors.As(cfg.Validate(), &cfgErr) {
+		for _, key := range cfgErr.Missing {
+			r.err.Missing = append(r.err.Missing, r.envKeys(key))
+		}
+		for _, problem := range cfgErr.Invalid {
+			key, reason, _ := strings.Cut(problem, ": ")
+			r.err.Invalid = append(r.err.Invalid, r.envKeys(key)+": "+reason)
+		}
+	}
+
+	if len(r.err.Missing) > 0 || len(r.err.Invalid) > 0 {
+		return cfg, &r.err
+	}
+	return cfg, nil
+}
+
+// envFields maps the Config field names used by Validate to variable names
+var envFields = map[string]string{
+	"Provider":            "PROVIDER",
+	"SendMethod":          "SEND_METHOD",
+	"Token":               "TOKEN",
+	"SlackToken":          "SLACK_TOKEN",
+	"LarkToken.AppID":     "LARK_APP_ID",
+	"LarkToken.AppSecret": "LARK_APP_SECRET",
+	"RedisHost":           "REDIS_HOST",
+	"RedisPort":           "REDIS_PORT",
+}
+
+// envKeys replaces the Config field names in a Validate key, such as "Token or SlackToken", with
+// variable names
+func (r *envReader) envKeys(key string) string {
+	words := strings.Fields(key)
+	for i, word := range words {
+		if name, ok := envFields[word]; ok {
+			words[i] = r.key(name)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// larkDomain resolves "lark", "feishu" or a base URL to a LarkTokenConfig domain
+func larkDomain(domain string) (string, bool) {
+	switch strings.ToLower(domain) {
+	case "", "lark":
+		return "", true
+	case "feishu":
+		return types.LarkDomainFeishu, true
+	default:
+		return domain, strings.HasPrefix(domain, "https://") || strings.HasPrefix(domain, "http://")
+	}
+}
+
+// readChannelMap builds a channel resolver from the CHANNEL_<LEVEL> variables
+func (r *envReader) readChannelMap(cfg *types.Config) {
+	channelPrefix := r.key("CHANNEL_")
+	var keys []string
+	for _, env := range os.Environ() {
+		if key, _, _ := strings.Cut(env, "="); strings.HasPrefix(key, channelPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	channels := make(map[types.Level]string)
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, r.prefix+"_")
+		level, err := types.ParseLevel(strings.TrimPrefix(key, channelPrefix))
+		if err != nil {
+			r.invalid(name, "%q is not a level", strings.TrimPrefix(key, channelPrefix))
+			continue
+		}
+		if channel := r.get(name); channel != "" {
+			channels[level] = channel
+		}
+	}
+	if len(channels) > 0 {
+		cfg.ChannelResolver = &types.DefaultChannelResolver{ChannelMap: channels, DefaultChannel: cfg.Channel}
+	}
+}
+
+// readRedis reads the Redis options
+func (r *envReader) readRedis(cfg *types.Config) {
+	if addrs := r.get("REDIS_ADDRS"); addrs != "" {
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				cfg.Redis.Addrs = append(cfg.Redis.Addrs, addr)
+			}
+		}
+	}
+	cfg.RedisHost = r.get("REDIS_HOST")
+	cfg.RedisPort = r.get("REDIS_PORT")
+	if cfg.RedisPort != "" {
+		if port, err := strconv.Atoi(cfg.RedisPort); err != nil || port <= 0 || port > 65535 {
+			r.invalid("REDIS_PORT", "%q is not a port", cfg.RedisPort)
+		}
+	}
+	cfg.Redis.MasterName = r.get("REDIS_MASTER_NAME")
+	cfg.Redis.Username = r.get("REDIS_USERNAME")
+	cfg.Redis.Password = r.get("REDIS_PASSWORD")
+	cfg.Redis.DB = r.int("REDIS_DB")
+}
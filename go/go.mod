@@ -1,11 +1,24 @@
 module github.com/alvianhanif/commonlog/go
 
-go 1.19
+go 1.21
 
-require github.com/go-redis/redis/v8 v8.11.0
+require (
+	github.com/alicebob/miniredis/v2 v2.30.4
+	github.com/go-redis/redis/v8 v8.11.0
+	google.golang.org/grpc v1.62.1
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/onsi/gomega v1.27.10 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240123012728-ef4313101c80 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
 )
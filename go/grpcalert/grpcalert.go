@@ -0,0 +1,197 @@
+// Package grpcalert provides gRPC server interceptors that send commonlog alerts for panics and
+// selected error statuses.
+package grpcalert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	commonlog "github.com/alvianhanif/commonlog/go"
+	"github.com/alvianhanif/commonlog/go/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCodes are the status codes alerted when Options.Codes is nil
+var DefaultCodes = []codes.Code{codes.Internal, codes.Unavailable, codes.DataLoss}
+
+// defaultRedactedMetadata are redacted from alerts in addition to Options.RedactMetadata
+var defaultRedactedMetadata = []string{"authorization", "cookie", "x-api-key"}
+
+// maxMetadataValueBytes bounds each metadata value copied into an alert
+const maxMetadataValueBytes = 256
+
+// Options configures the interceptors
+type Options struct {
+	// Channel overrides the channel resolved by the Logger
+	Channel string
+	// Codes lists the status codes returned by handlers that trigger an alert (defaults to DefaultCodes)
+	Codes []codes.Code
+	// Level is the alert level for panics and alerted statuses (defaults to ERROR)
+	Level types.Level
+	// MethodLevels overrides Level per full method name, e.g. "/billing.v1.Billing/Charge"
+	MethodLevels map[string]types.Level
+	// Ignore lists full method names, or service prefixes ending in "/" such as "/grpc.health.v1.Health/",
+	// that never alert. Panics in ignored methods are still recovered.
+	Ignore []string
+	// RedactMetadata lists additional metadata keys whose values are redacted; authorization,
+	// cookie and x-api-key are always redacted
+	RedactMetadata []string
+	// Metadata lists the metadata keys copied into alerts; nil copies every key. Binary "-bin" keys
+	// are never copied, and values are cut at 256 bytes.
+	Metadata []string
+}
+
+// interceptor holds the resolved options shared by the unary and stream interceptors
+type interceptor struct {
+	logger *commonlog.Logger
+	opts   Options
+	codes  map[codes.Code]bool
+	redact map[string]bool
+	keep   map[string]bool // nil keeps every key
+}
+
+func newInterceptor(logger *commonlog.Logger, opts *Options) *interceptor {
+	i := &interceptor{logger: logger, codes: make(map[codes.Code]bool), redact: make(map[string]bool)}
+	if opts != nil {
+		i.opts = *opts
+	}
+	if i.opts.Level == 0 {
+		i.opts.Level = types.ERROR
+	}
+	alerted := i.opts.Codes
+	if alerted == nil {
+		alerted = DefaultCodes
+	}
+	for _, code := range alerted {
+		i.codes[code] = true
+	}
+	for _, key := range append(defaultRedactedMetadata, i.opts.RedactMetadata...) {
+		i.redact[strings.ToLower(key)] = true
+	}
+	if i.opts.Metadata != nil {
+		i.keep = make(map[string]bool)
+		for _, key := range i.opts.Metadata {
+			i.keep[strings.ToLower(key)] = true
+		}
+	}
+	return i
+}
+
+// UnaryServerInterceptor returns an interceptor that recovers panics in unary handlers, returning
+// codes.Internal, and alerts on panics and on the configured status codes
+func UnaryServerInterceptor(logger *commonlog.Logger, opts *Options) grpc.UnaryServerInterceptor {
+	i := newInterceptor(logger, opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		start := time.Now()
+		defer func() {
+			if value := recover(); value != nil {
+				err = i.panicked(ctx, info.FullMethod, start, value)
+			}
+		}()
+		resp, err = handler(ctx, req)
+		i.finished(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that recovers panics in stream handlers, returning
+// codes.Internal, and alerts on panics and on the configured status codes
+func StreamServerInterceptor(logger *commonlog.Logger, opts *Options) grpc.StreamServerInterceptor {
+	i := newInterceptor(logger, opts)
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		ctx := stream.Context()
+		defer func() {
+			if value := recover(); value != nil {
+				err = i.panicked(ctx, info.FullMethod, start, value)
+			}
+		}()
+		err = handler(srv, stream)
+		i.finished(ctx, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// panicked alerts on a recovered panic and returns the status sent to the client. It must be called
+// from the deferred function so that the trace holds the stack of the panic.
+func (i *interceptor) panicked(ctx context.Context, method string, start time.Time, value interface{}) error {
+	if !i.ignored(method) {
+		err, _ := value.(error)
+		trace := i.logger.CaptureTrace(i.level(method), err)
+		i.send(ctx, method, start, codes.Internal, fmt.Sprintf("panic in %s: %v", method, value), trace)
+	}
+	return status.Error(codes.Internal, "internal error")
+}
+
+// finished alerts when a handler returned one of the alerted status codes
+func (i *interceptor) finished(ctx context.Context, method string, start time.Time, err error) {
+	if err == nil || i.ignored(method) {
+		return
+	}
+	st := status.Convert(err)
+	if !i.codes[st.Code()] {
+		return
+	}
+	i.send(ctx, method, start, st.Code(), fmt.Sprintf("%s failed with %s: %s", method, st.Code(), st.Message()), "")
+}
+
+// send queues an alert with the method, status code, latency, peer and request metadata as fields
+func (i *interceptor) send(ctx context.Context, method string, start time.Time, code codes.Code, message, trace string) {
+	fields := []interface{}{
+		"grpc_method", method,
+		"grpc_code", code.String(),
+		"latency", time.Since(start).Round(time.Millisecond).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields = append(fields, "peer", p.Addr.String())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		keys := make([]string, 0, len(md))
+		for key := range md {
+			if strings.HasSuffix(key, "-bin") || (i.keep != nil && !i.keep[key]) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := strings.Join(md[key], ", ")
+			if len(value) > maxMetadataValueBytes {
+				// Text metadata is printable ASCII, so a byte cut never splits a character
+				value = value[:maxMetadataValueBytes] + "..."
+			}
+			if i.redact[key] {
+				value = "[REDACTED]"
+			}
+			fields = append(fields, "md."+key, value)
+		}
+	}
+
+	alert := &types.Alert{Level: i.level(method), Message: message, Trace: trace, Timestamp: time.Now()}
+	i.logger.With(fields...).DeliverAsync(context.WithoutCancel(ctx), alert, i.opts.Channel)
+}
+
+// level returns the alert level for a method
+func (i *interceptor) level(method string) types.Level {
+	if level, ok := i.opts.MethodLevels[method]; ok {
+		return level
+	}
+	return i.opts.Level
+}
+
+// ignored reports whether alerts for a method are suppressed
+func (i *interceptor) ignored(method string) bool {
+	for _, pattern := range i.opts.Ignore {
+		if pattern == method || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(method, pattern)) {
+			return true
+		}
+	}
+	return false
+}
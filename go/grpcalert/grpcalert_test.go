@@ -0,0 +1,193 @@
+package grpcalert
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	commonlog "github.com/alvianhanif/commonlog/go"
+	"github.com/alvianhanif/commonlog/go/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// healthServer misbehaves depending on the requested service name
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (s *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	switch req.Service {
+	case "panic":
+		var m map[string]int
+		m["boom"]++
+	case "unavailable":
+		return nil, status.Error(codes.Unavailable, "database down")
+	case "not-found":
+		return nil, status.Error(codes.NotFound, "no such service")
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	panic("stream exploded")
+}
+
+// setup starts an in-process server with the interceptors and returns a client and a function that
+// closes the Logger, delivering the queued alerts, and returns the captured alerts
+func setup(t *testing.T, opts *Options) (healthpb.HealthClient, func() []map[string]interface{}) {
+	var mu sync.Mutex
+	var alerts []map[string]interface{}
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&alert)
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	t.Cleanup(endpoint.Close)
+
+	logger := commonlog.NewLogger(types.Config{
+		Provider:  "generic",
+		Token:     endpoint.URL,
+		LocalSink: commonlog.NewWriterSink(io.Discard),
+	})
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(logger, opts)),
+		grpc.StreamInterceptor(StreamServerInterceptor(logger, opts)),
+	)
+	healthpb.RegisterHealthServer(server, &healthServer{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return healthpb.NewHealthClient(conn), func() []map[string]interface{} {
+		logger.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]interface{}(nil), alerts...)
+	}
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	client, alerts := setup(t, &Options{
+		MethodLevels:   map[string]types.Level{"/grpc.health.v1.Health/Check": types.CRITICAL},
+		RedactMetadata: []string{"x-session"},
+	})
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"x-request-id", "req-9", "authorization", "Bearer secret", "x-session", "s3cret")
+
+	for _, service := range []string{"", "not-found", "unavailable", "panic"} {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if service == "panic" && status.Code(err) != codes.Internal {
+			t.Errorf("Expected Internal after panic, got %v", err)
+		}
+	}
+
+	got := alerts()
+	if len(got) != 2 {
+		t.Fatalf("Expected alerts for Unavailable and the panic only, got %d: %v", len(got), got)
+	}
+	if got[0]["message"] != "/grpc.health.v1.Health/Check failed with Unavailable: database down" {
+		t.Errorf("Unexpected message %v", got[0]["message"])
+	}
+	if !strings.HasPrefix(got[1]["message"].(string), "panic in /grpc.health.v1.Health/Check: assignment to entry in nil map") {
+		t.Errorf("Unexpected message %v", got[1]["message"])
+	}
+	if !strings.Contains(got[1]["trace"].(string), "(*healthServer).Check") {
+		t.Errorf("Expected trace with the handler frame, got:\n%s", got[1]["trace"])
+	}
+	for _, alert := range got {
+		if alert["level"] != "CRITICAL" {
+			t.Errorf("Expected method level override, got %v", alert["level"])
+		}
+		fields := alert["fields"].(map[string]interface{})
+		for key, want := range map[string]interface{}{
+			"grpc_method":      "/grpc.health.v1.Health/Check",
+			"md.x-request-id":  "req-9",
+			"md.authorization": "[REDACTED]",
+			"md.x-session":     "[REDACTED]",
+		} {
+			if fields[key] != want {
+				t.Errorf("Expected field %s=%v, got %v", key, want, fields[key])
+			}
+		}
+		if fields["peer"] == nil || fields["grpc_code"] == nil {
+			t.Errorf("Expected peer and grpc_code fields, got %v", fields)
+		}
+	}
+}
+
+func TestMetadataFields(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"x-request-id", "req-9", "trace-bin", string([]byte{0, 1, 2}), "x-long", long)
+
+	client, alerts := setup(t, nil)
+	client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unavailable"})
+	got := alerts()
+	if len(got) != 1 {
+		t.Fatalf("Expected one alert, got %v", got)
+	}
+	fields := got[0]["fields"].(map[string]interface{})
+	if _, ok := fields["md.trace-bin"]; ok {
+		t.Errorf("Expected binary metadata to be skipped, got %q", fields["md.trace-bin"])
+	}
+	if want := strings.Repeat("a", 256) + "..."; fields["md.x-long"] != want {
+		t.Errorf("Expected long value cut at 256 bytes, got %q", fields["md.x-long"])
+	}
+
+	client, alerts = setup(t, &Options{Metadata: []string{"X-Request-ID"}})
+	client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unavailable"})
+	got = alerts()
+	if len(got) != 1 {
+		t.Fatalf("Expected one alert, got %v", got)
+	}
+	fields = got[0]["fields"].(map[string]interface{})
+	if fields["md.x-request-id"] != "req-9" || fields["md.x-long"] != nil || fields["md.user-agent"] != nil {
+		t.Errorf("Expected only allowlisted metadata, got %v", fields)
+	}
+}
+
+func TestStreamInterceptorAndIgnore(t *testing.T) {
+	client, alerts := setup(t, nil)
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal after stream panic, got %v", err)
+	}
+	got := alerts()
+	if len(got) != 1 || got[0]["message"] != "panic in /grpc.health.v1.Health/Watch: stream exploded" || got[0]["level"] != "ERROR" {
+		t.Errorf("Expected one ERROR alert for the stream panic, got %v", got)
+	}
+
+	ignoring, ignoredAlerts := setup(t, &Options{Ignore: []string{"/grpc.health.v1.Health/"}})
+	if _, err := ignoring.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "panic"}); status.Code(err) != codes.Internal {
+		t.Errorf("Expected ignored panics to still be recovered, got %v", err)
+	}
+	if got := ignoredAlerts(); len(got) != 0 {
+		t.Errorf("Expected no alerts for ignored service, got %v", got)
+	}
+}
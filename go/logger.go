@@ -1,8 +1,14 @@
 package commonlog
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/alvianhanif/commonlog/go/cache"
 	"github.com/alvianhanif/commonlog/go/providers"
 	"github.com/alvianhanif/commonlog/go/types"
 )
@@ -18,6 +24,8 @@ func createProvider(providerName string) types.Provider {
 		return &providers.SlackProvider{}
 	case "lark":
 		return &providers.LarkProvider{}
+	case "generic":
+		return &providers.GenericProvider{}
 	default:
 		return &providers.SlackProvider{}
 	}
@@ -25,140 +33,420 @@ func createProvider(providerName string) types.Provider {
 
 // Logger is the main struct
 type Logger struct {
-	config   types.Config
-	provider types.Provider
+	config    types.Config
+	provider  types.Provider
+	resources *loggerResources // shared with loggers derived by With
+}
+
+// loggerResources holds state shared by a Logger and the loggers derived from it
+type loggerResources struct {
+	mu              sync.Mutex
+	closers         []io.Closer               // resources owned by the Logger, released by Close
+	customProviders map[string]types.Provider // providers created by CustomSend, reused across calls
+	dedup           *deduper                  // repeat suppression, nil when DedupWindow is unset
+	batches         *batcher                  // per-channel digests, nil when BatchMaxLevel is unset
+	breakers        *breakers                 // per-endpoint circuit breakers, nil when FailureThreshold is unset
+	limiter         *rateLimiter              // per-channel rate limits
+	spool           *spool                    // undeliverable alerts awaiting replay, nil when Spool.Dir is unset
+	async           *asyncQueue               // alerts queued by DeliverAsync
+	httpErr         error                     // invalid HTTP options, failing every remote delivery
 }
 
 // NewLogger creates a new Logger with the appropriate provider
 func NewLogger(cfg types.Config) *Logger {
 	provider := createProvider(cfg.Provider)
-	logger := &Logger{config: cfg, provider: provider}
+	logger := &Logger{config: cfg, provider: provider, resources: &loggerResources{limiter: newRateLimiter()}}
+
+	// Build the HTTP client once, so that connections are reused across requests. Invalid options fail
+	// remote deliveries rather than silently bypassing a proxy or CA pinning.
+	if cfg.HTTP.Client == nil {
+		client, err := cfg.HTTP.NewClient()
+		if err != nil {
+			fmt.Printf("[commonlog] Warning: invalid HTTP options, alerts are only logged locally: %v\n", err)
+			logger.resources.httpErr = fmt.Errorf("invalid HTTP options: %w", err)
+		} else {
+			logger.config.HTTP.Client = client
+		}
+	}
+
+	// Closed first, so that queued alerts, pending digests and summaries are sent before the provider
+	// and cache are released
+	logger.resources.async = newAsyncQueue(cfg.AsyncQueueSize)
+	logger.resources.closers = append(logger.resources.closers, logger.resources.async)
+	if cfg.DedupWindow > 0 {
+		logger.resources.dedup = newDeduper(cfg.DedupStore)
+		logger.resources.closers = append(logger.resources.closers, logger.resources.dedup)
+	}
+	if cfg.BatchMaxLevel > 0 {
+		logger.resources.batches = newBatcher()
+		logger.resources.closers = append(logger.resources.closers, logger.resources.batches)
+	}
+	logger.resources.closers = append(logger.resources.closers, logger.resources.limiter)
+	if cfg.Spool.Dir != "" {
+		if s, err := openSpool(cfg.Spool); err != nil {
+			fmt.Printf("[commonlog] Warning: spool disabled: %v\n", err)
+		} else {
+			logger.resources.spool = s
+			logger.resources.closers = append(logger.resources.closers, s)
+		}
+	}
+	if cfg.CircuitBreaker.FailureThreshold > 0 {
+		logger.resources.breakers = newBreakers(logger.config)
+		logger.resources.closers = append(logger.resources.closers, logger.resources.breakers)
+	}
+	if closer, ok := provider.(io.Closer); ok {
+		logger.resources.closers = append(logger.resources.closers, closer)
+	}
+
+	// Hold one Redis client for the Logger's lifetime instead of connecting per cache access
+	if cfg.Cache == nil {
+		if cfg.Redis.Client != nil {
+			logger.config.Cache = cache.NewRedis(cfg.Redis.Client)
+			types.DebugLog(cfg, "Using provided Redis client for caching")
+		} else if opts := cfg.RedisOptions(); opts != nil {
+			redisCache := cache.NewRedisFromOptions(opts)
+			logger.config.Cache = redisCache
+			logger.resources.closers = append(logger.resources.closers, redisCache)
+			types.DebugLog(cfg, "Created shared Redis client for addresses: %v", opts.Addrs)
+		}
+	}
 
 	types.DebugLog(cfg, "Created new logger with provider: %s, send method: %s, debug: %t",
 		cfg.Provider, cfg.SendMethod, cfg.Debug)
 
+	if logger.resources.spool != nil {
+		logger.resources.spool.start(logger.replaySpooled)
+	}
+
 	return logger
 }
 
+// With returns a Logger that adds the given fields to every alert it sends. Fields are given as
+// alternating keys and values, e.g. With("request_id", id, "user_id", uid); a key without a value is
+// recorded with a nil value. The returned Logger shares the parent's provider and resources.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.config.Fields)+len(keysAndValues)/2)
+	for k, v := range l.config.Fields {
+		fields[k] = v
+	}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		var value interface{}
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fields[key] = value
+	}
+	child := *l
+	child.config.Fields = fields
+	return &child
+}
+
+// Close releases resources held by the Logger, such as its Redis client. Loggers derived with With
+// share these resources, so closing any of them closes all. The Logger must not be used after Close.
+func (l *Logger) Close() error {
+	r := l.resources
+	r.mu.Lock()
+	closers := r.closers
+	for _, p := range r.customProviders {
+		if closer, ok := p.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
+	}
+	r.closers = nil
+	r.customProviders = nil
+	r.mu.Unlock()
+
+	var firstErr error
+	for _, c := range closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// customProvider returns the provider used by CustomSend for name, creating it on first use
+// so that provider state such as cached tokens is kept between calls
+func (l *Logger) customProvider(name string) types.Provider {
+	r := l.resources
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.customProviders[name]; ok {
+		return p
+	}
+	if r.customProviders == nil {
+		r.customProviders = make(map[string]types.Provider)
+	}
+	p := createProvider(name)
+	r.customProviders[name] = p
+	return p
+}
+
+// SyncLarkChats pages through the Lark chat directory once and caches the chat_id of every chat the
+// bot belongs to, so that later sends skip the per-channel lookup. Chat names shared by several chats
+// are not cached and are reported in a *providers.DuplicateChatNamesError.
+func (l *Logger) SyncLarkChats(ctx context.Context) error {
+	lark, ok := l.provider.(*providers.LarkProvider)
+	if !ok {
+		return fmt.Errorf("SyncLarkChats requires the lark provider, got %s", l.config.Provider)
+	}
+	if l.resources.httpErr != nil {
+		return l.resources.httpErr
+	}
+	cached, err := lark.SyncChats(ctx, l.config)
+	types.DebugLog(l.config, "SyncLarkChats cached %d chats", cached)
+	return err
+}
+
+// isLocalOnly reports whether messages at level are logged locally instead of sent to the provider
+func (l *Logger) isLocalOnly(level types.Level) bool {
+	return level < l.config.RemoteLevel()
+}
+
 // resolveChannel resolves the channel for the given alert level
-func (l *Logger) resolveChannel(level int) string {
+func (l *Logger) resolveChannel(level types.Level) string {
 	if l.config.ChannelResolver != nil {
 		return l.config.ChannelResolver.ResolveChannel(level)
 	}
 	return l.config.Channel
 }
 
-// Send sends a message with alert level, optional attachment, and optional trace log
-func (l *Logger) Send(level int, message string, attachment *types.Attachment, trace string) error {
-	return l.SendToChannel(level, message, attachment, trace, "")
+// newAlert builds an alert from the positional arguments of the Logger's send methods
+func (l *Logger) newAlert(level types.Level, message string, attachment *types.Attachment, trace string) *types.Alert {
+	alert := &types.Alert{
+		Level:     level,
+		Message:   message,
+		Trace:     trace,
+		Timestamp: time.Now(),
+	}
+	if attachment != nil {
+		alert.Attachments = []types.Attachment{*attachment}
+	}
+	return alert
 }
 
-// SendToChannel sends a message to a specific channel, overriding the default/channel resolver
-func (l *Logger) SendToChannel(level int, message string, attachment *types.Attachment, trace string, channel string) error {
-	types.DebugLog(l.config, "SendToChannel called with level: %d, message length: %d, channel: %s, has attachment: %t, has trace: %t",
-		level, len(message), channel, attachment != nil, trace != "")
+// prepareAlert returns a copy of alert with the Logger's fields merged in, without overriding fields
+// set on the alert, and the timestamp defaulted to now
+func (l *Logger) prepareAlert(alert *types.Alert) *types.Alert {
+	prepared := *alert
+	if prepared.Timestamp.IsZero() {
+		prepared.Timestamp = time.Now()
+	}
+	if len(l.config.Fields) > 0 {
+		if len(prepared.Fields) == 0 {
+			prepared.Fields = l.config.Fields
+		} else {
+			fields := make(map[string]interface{}, len(l.config.Fields)+len(prepared.Fields))
+			for k, v := range l.config.Fields {
+				fields[k] = v
+			}
+			for k, v := range prepared.Fields {
+				fields[k] = v
+			}
+			prepared.Fields = fields
+		}
+	}
+	return &prepared
+}
 
-	if level == types.INFO {
-		log.Printf("[INFO] %s", message)
-		types.DebugLog(l.config, "INFO level message logged locally, skipping provider send")
-		return nil
+// sendAlert delivers an alert through provider and mirrors it to the local sink. Alerts below
+// MinRemoteLevel are only logged locally, unless they reply to or replace a delivered message, and
+// repeats within DedupWindow are only logged locally until their digest is sent. Alerts up to
+// BatchMaxLevel are buffered per channel and sent together as one digest.
+func (l *Logger) sendAlert(ctx context.Context, provider types.Provider, providerName string, alert *types.Alert, channel string, replace *types.MessageRef) (*types.DeliveryResult, error) {
+	alert = l.prepareAlert(alert)
+	types.DebugLog(l.config, "sendAlert called with provider: %s, level: %s, message length: %d, channel: %s, attachments: %d, has trace: %t",
+		providerName, alert.Level, len(alert.Message), channel, len(alert.Attachments), alert.Trace != "")
+
+	if alert.ThreadRef == nil && replace == nil && l.isLocalOnly(alert.Level) {
+		l.logLocal(ctx, alert, "", "", false, nil)
+		types.DebugLog(l.config, "%s level message logged locally, skipping provider send", alert.Level)
+		return nil, nil
 	}
 
-	resolvedChannel := channel
-	if resolvedChannel == "" {
-		resolvedChannel = l.resolveChannel(level)
-		types.DebugLog(l.config, "Resolved channel using resolver: %s", resolvedChannel)
+	if channel == "" {
+		channel = l.resolveChannel(alert.Level)
+		types.DebugLog(l.config, "Resolved channel using resolver: %s", channel)
 	} else {
-		types.DebugLog(l.config, "Using provided channel: %s", resolvedChannel)
-	}
-
-	sendConfig := l.config
-	sendConfig.Channel = resolvedChannel
-
-	if trace != "" {
-		types.DebugLog(l.config, "Processing trace attachment, trace length: %d", len(trace))
-		traceAttachment := &types.Attachment{
-			FileName: "trace.log",
-			Content:  trace,
-		}
-		if attachment != nil {
-			if attachment.Content != "" {
-				attachment.Content += "\n\n--- Trace Log ---\n" + trace
-				types.DebugLog(l.config, "Appended trace to existing attachment content")
-			} else {
-				attachment.Content = trace
-				attachment.FileName = "trace.log"
-				types.DebugLog(l.config, "Set trace as attachment content")
+		types.DebugLog(l.config, "Using provided channel: %s", channel)
+	}
+
+	if d := l.resources.dedup; d != nil && alert.ThreadRef == nil && replace == nil {
+		digest := func(count int64) {
+			l.dispatchAlert(context.Background(), provider, providerName, digestAlert(alert, count, l.config.DedupWindow), channel, nil)
+		}
+		if !d.admit(ctx, l, providerName, channel, alert, digest) {
+			l.logLocal(ctx, alert, "", "", false, nil)
+			return nil, nil
+		}
+	}
+	if b := l.resources.batches; b != nil && l.batchable(alert, replace) {
+		flush := func(alerts []*types.Alert, started time.Time) {
+			l.dispatchAlert(context.Background(), provider, providerName, l.batchDigest(alerts, started), channel, nil)
+		}
+		interval, size := l.config.BatchInterval, l.config.BatchSize
+		if interval <= 0 {
+			interval = defaultBatchInterval
+		}
+		if size <= 0 {
+			size = defaultBatchSize
+		}
+		l.logLocal(ctx, alert, "", "", false, nil)
+		full, started := b.add(providerName+"|"+channel, alert, interval, size, flush)
+		if full == nil {
+			return nil, nil
+		}
+		return l.dispatchAlert(ctx, provider, providerName, l.batchDigest(full, started), channel, nil)
+	}
+	return l.dispatchAlert(ctx, provider, providerName, alert, channel, replace)
+}
+
+// dispatchAlert applies the channel's rate limit before delivering, queueing, dropping or
+// summarizing alerts over it according to RateLimitPolicy
+func (l *Logger) dispatchAlert(ctx context.Context, provider types.Provider, providerName string, alert *types.Alert, channel string, replace *types.MessageRef) (*types.DeliveryResult, error) {
+	if limit := l.config.RateLimitFor(providerName); limit.Rate > 0 {
+		if ok, err := l.resources.limiter.admit(ctx, l, provider, providerName, alert, channel, limit); !ok {
+			return nil, err
+		}
+	}
+	return l.deliverAlert(ctx, provider, providerName, alert, channel, replace)
+}
+
+// deliverAlert delivers a prepared alert to a resolved channel and mirrors it to the local sink.
+// Alerts that could not be delivered at all are spooled for replay; the error is still returned.
+func (l *Logger) deliverAlert(ctx context.Context, provider types.Provider, providerName string, alert *types.Alert, channel string, replace *types.MessageRef) (*types.DeliveryResult, error) {
+	spool := l.resources.spool != nil && replace == nil
+	if spool {
+		// Read attachment content up front, so that the spooled alert still has it
+		loaded := *alert
+		if loaded.LoadAttachments() == nil {
+			alert = &loaded
+		}
+	}
+	result, err := l.attemptDelivery(ctx, provider, providerName, alert, channel, replace)
+	if spool && result == nil && retryable(err) {
+		l.spoolAlert(alert, providerName, channel)
+	}
+	return result, err
+}
+
+// attemptDelivery delivers an alert once and mirrors it to the local sink. While the endpoint's
+// circuit is open the alert fails fast, or goes to the circuit breaker's failover.
+func (l *Logger) attemptDelivery(ctx context.Context, provider types.Provider, providerName string, alert *types.Alert, channel string, replace *types.MessageRef) (*types.DeliveryResult, error) {
+	if err := l.resources.httpErr; err != nil {
+		l.logLocal(ctx, alert, providerName, channel, false, err)
+		return nil, err
+	}
+	target := types.Target{Channel: channel, Config: l.config, Replace: replace}
+	target.Config.Channel = channel
+
+	endpoint := ""
+	if l.resources.breakers != nil {
+		endpoint = circuitEndpoint(providerName, target.Config)
+		if err := l.allowDelivery(endpoint); err != nil {
+			types.DebugLog(l.config, "Provider.Deliver skipped: %v", err)
+			if l.resources.breakers.failover != nil {
+				return l.failoverAlert(ctx, alert)
 			}
-		} else {
-			attachment = traceAttachment
-			types.DebugLog(l.config, "Created new trace attachment")
+			l.logLocal(ctx, alert, providerName, channel, false, err)
+			return nil, err
 		}
 	}
 
-	types.DebugLog(l.config, "Calling provider.SendToChannel with resolved channel: %s", resolvedChannel)
-	err := l.provider.SendToChannel(level, message, attachment, sendConfig, resolvedChannel)
+	result, err := provider.Deliver(ctx, alert, target)
+	if endpoint != "" {
+		// Only transport errors, timeouts, 5xx and 429 count against the endpoint. A partial failure, or
+		// an API error such as an unknown channel, shows the endpoint is up.
+		failure := err
+		if result != nil || !types.IsTransient(err) {
+			failure = nil
+		}
+		l.recordDelivery(ctx, endpoint, failure)
+	}
 	if err != nil {
-		types.DebugLog(l.config, "Provider.SendToChannel failed: %v", err)
+		types.DebugLog(l.config, "Provider.Deliver failed: %v", err)
 	} else {
-		types.DebugLog(l.config, "Provider.SendToChannel completed successfully")
+		types.DebugLog(l.config, "Provider.Deliver completed successfully")
 	}
-	return err
+	l.logLocal(ctx, alert, providerName, channel, true, err)
+	return result, err
 }
 
-// CustomSend sends a message with a custom provider, allowing override of the default provider
-func (l *Logger) CustomSend(provider string, level int, message string, attachment *types.Attachment, trace string, channel string) error {
-	types.DebugLog(l.config, "CustomSend called with custom provider: %s, level: %d, message length: %d",
-		provider, level, len(message))
+// Deliver sends an alert to channel, or to the channel resolved for its level when channel is empty.
+// The Logger's fields are merged into the alert's fields, and the alert itself is not modified. When
+// alert.ThreadRef is set the alert is posted as a reply in that thread, regardless of level. The
+// result is nil for alerts below MinRemoteLevel, which are only logged locally.
+func (l *Logger) Deliver(ctx context.Context, alert *types.Alert, channel string) (*types.DeliveryResult, error) {
+	if alert == nil {
+		return nil, fmt.Errorf("alert is required")
+	}
+	if channel == "" && alert.ThreadRef != nil {
+		channel = alert.ThreadRef.Channel
+	}
+	return l.sendAlert(ctx, l.provider, l.config.Provider, alert, channel, nil)
+}
 
-	customProvider := createProvider(provider)
-	if customProvider == nil {
-		log.Printf("[ERROR] Unknown provider: %s, defaulting to slack", provider)
-		customProvider = createProvider("slack")
-		types.DebugLog(l.config, "Unknown provider '%s', defaulted to slack", provider)
-	} else {
-		types.DebugLog(l.config, "Created custom provider: %s", provider)
+// Send sends a message with alert level, optional attachment, and optional trace log
+func (l *Logger) Send(level types.Level, message string, attachment *types.Attachment, trace string) error {
+	return l.SendToChannel(level, message, attachment, trace, "")
+}
+
+// SendToChannel sends a message to a specific channel, overriding the default/channel resolver
+func (l *Logger) SendToChannel(level types.Level, message string, attachment *types.Attachment, trace string, channel string) error {
+	_, err := l.Deliver(context.Background(), l.newAlert(level, message, attachment, trace), channel)
+	return err
+}
+
+// SendWithRef sends a message like SendToChannel and returns a reference to the delivered message,
+// which can be passed to Reply and Update. The reference is nil for messages below MinRemoteLevel, which are only
+// logged locally, and for providers and send methods that do not report message IDs, such as webhooks.
+// If the message was delivered but an attachment upload failed, both the reference and the error are returned.
+func (l *Logger) SendWithRef(level types.Level, message string, attachment *types.Attachment, trace string, channel string) (*types.MessageRef, error) {
+	result, err := l.Deliver(context.Background(), l.newAlert(level, message, attachment, trace), channel)
+	if result == nil {
+		return nil, err
 	}
+	return result.Ref, err
+}
 
-	if level == types.INFO {
-		log.Printf("[INFO] %s", message)
-		types.DebugLog(l.config, "INFO level message logged locally for custom provider, skipping send")
-		return nil
+// Reply posts a follow-up message in the thread of a message previously delivered with SendWithRef.
+// Replies are always delivered remotely, regardless of level.
+func (l *Logger) Reply(ref *types.MessageRef, level types.Level, message string, attachment *types.Attachment, trace string) (*types.MessageRef, error) {
+	if ref == nil {
+		return nil, fmt.Errorf("message reference is required")
 	}
+	alert := l.newAlert(level, message, attachment, trace)
+	alert.ThreadRef = ref
+	result, err := l.sendAlert(context.Background(), l.provider, l.config.Provider, alert, ref.Channel, nil)
+	if result == nil {
+		return nil, err
+	}
+	return result.Ref, err
+}
 
-	resolvedChannel := channel
-	if resolvedChannel == "" {
-		resolvedChannel = l.resolveChannel(level)
-		types.DebugLog(l.config, "Resolved channel for custom send: %s", resolvedChannel)
+// Update replaces the content of a message previously delivered with SendWithRef,
+// for example to mark an incident as resolved. Updates are always delivered remotely, regardless of level.
+func (l *Logger) Update(ref *types.MessageRef, level types.Level, message string, attachment *types.Attachment, trace string) error {
+	if ref == nil {
+		return fmt.Errorf("message reference is required")
 	}
+	_, err := l.sendAlert(context.Background(), l.provider, l.config.Provider, l.newAlert(level, message, attachment, trace), ref.Channel, ref)
+	return err
+}
 
-	sendConfig := l.config
-	sendConfig.Channel = resolvedChannel
+// CustomSend sends a message with a custom provider, allowing override of the default provider
+func (l *Logger) CustomSend(provider string, level types.Level, message string, attachment *types.Attachment, trace string, channel string) error {
+	types.DebugLog(l.config, "CustomSend called with custom provider: %s, level: %s, message length: %d",
+		provider, level, len(message))
 
-	if trace != "" {
-		types.DebugLog(l.config, "Processing trace for custom send, trace length: %d", len(trace))
-		traceAttachment := &types.Attachment{
-			FileName: "trace.log",
-			Content:  trace,
-		}
-		if attachment != nil {
-			if attachment.Content != "" {
-				attachment.Content += "\n\n--- Trace Log ---\n" + trace
-			} else {
-				attachment.Content = trace
-				attachment.FileName = "trace.log"
-			}
-		} else {
-			attachment = traceAttachment
-		}
+	customProvider := l.customProvider(provider)
+	if customProvider == nil {
+		log.Printf("[ERROR] Unknown provider: %s, defaulting to slack", provider)
+		customProvider = createProvider("slack")
+		types.DebugLog(l.config, "Unknown provider '%s', defaulted to slack", provider)
 	}
 
-	types.DebugLog(l.config, "Calling custom provider.SendToChannel with provider: %s, channel: %s", provider, resolvedChannel)
-	err := customProvider.SendToChannel(level, message, attachment, sendConfig, resolvedChannel)
-	if err != nil {
-		types.DebugLog(l.config, "Custom provider.SendToChannel failed: %v", err)
-	} else {
-		types.DebugLog(l.config, "Custom provider.SendToChannel completed successfully")
-	}
+	_, err := l.sendAlert(context.Background(), customProvider, provider, l.newAlert(level, message, attachment, trace), channel, nil)
 	return err
 }
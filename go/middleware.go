@@ -0,0 +1,369 @@
+package commonlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// HTTP Middleware
+// ====================
+
+// defaultRedactedHeaders are redacted from alerts in addition to HTTPMiddlewareOptions.RedactHeaders
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// defaultRedactedQuery are query parameters redacted from alerts in addition to
+// HTTPMiddlewareOptions.RedactQuery, compared case-insensitively
+var defaultRedactedQuery = []string{"access_token", "api_key", "apikey", "key", "token", "password", "secret",
+	"client_secret", "code", "signature", "sig"}
+
+// redacted replaces redacted header and query values and body matches
+const redacted = "[REDACTED]"
+
+// defaultMaxBodyBytes is the default limit on the request body captured for alerts
+const defaultMaxBodyBytes = 4 << 10
+
+// defaultErrorWindow is the default window for HTTPMiddlewareOptions.ErrorThreshold
+const defaultErrorWindow = time.Minute
+
+// HTTPMiddlewareOptions configures the middleware created by HTTPMiddleware
+type HTTPMiddlewareOptions struct {
+	// Channel overrides the channel resolved by the Logger
+	Channel string
+	// StatusThreshold enables alerts for responses with a status at or above it, e.g. 500.
+	// Zero only alerts on panics.
+	StatusThreshold int
+	// ErrorThreshold is the number of such responses within ErrorWindow that sends an alert, once per
+	// window (defaults to 1, which alerts on every such response)
+	ErrorThreshold int
+	// ErrorWindow is the window over which responses are counted for ErrorThreshold (defaults to 1m)
+	ErrorWindow time.Duration
+	// Route returns the route pattern that matched the request, e.g. from a router, for the "route" field
+	Route func(r *http.Request) string
+	// RequestIDHeader is the request header holding the request ID (defaults to "X-Request-Id")
+	RequestIDHeader string
+	// TrustProxyHeaders takes the client IP from X-Forwarded-For or X-Real-IP instead of the remote address
+	TrustProxyHeaders bool
+	// IncludeHeaders adds the request headers to the alert attachment
+	IncludeHeaders bool
+	// RedactHeaders lists additional header names whose values are redacted; Authorization,
+	// Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key are always redacted
+	RedactHeaders []string
+	// RedactQuery lists additional query parameters whose values are redacted from the request line;
+	// access_token, api_key, apikey, key, token, password, secret, client_secret, code, signature and
+	// sig are always redacted
+	RedactQuery []string
+	// IncludeBody adds the request body read by the handler, up to MaxBodyBytes, to the alert attachment
+	IncludeBody bool
+	// MaxBodyBytes limits the captured request body (defaults to 4 KiB)
+	MaxBodyBytes int
+	// RedactBody lists patterns whose matches in the captured body are redacted
+	RedactBody []*regexp.Regexp
+}
+
+// HTTPMiddleware returns net/http middleware that recovers panics in handlers, sends an ERROR alert
+// and responds with 500, and optionally alerts on responses at or above opts.StatusThreshold, when
+// opts.ErrorThreshold of them occur within opts.ErrorWindow. Alerts are queued with DeliverAsync and
+// carry the method, path, route, status, latency, client IP and request ID as fields; panics also
+// carry the stack as trace.
+func HTTPMiddleware(logger *Logger, opts *HTTPMiddlewareOptions) func(http.Handler) http.Handler {
+	var o HTTPMiddlewareOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.RequestIDHeader == "" {
+		o.RequestIDHeader = "X-Request-Id"
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if o.ErrorThreshold <= 0 {
+		o.ErrorThreshold = 1
+	}
+	if o.ErrorWindow <= 0 {
+		o.ErrorWindow = defaultErrorWindow
+	}
+	counter := &errorCounter{window: o.ErrorWindow}
+	redact := &redactions{headers: make(map[string]bool), query: make(map[string]bool)}
+	for _, name := range append(defaultRedactedHeaders, o.RedactHeaders...) {
+		redact.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range append(defaultRedactedQuery, o.RedactQuery...) {
+		redact.query[strings.ToLower(name)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			var rw http.ResponseWriter = rec
+			if _, ok := w.(http.Hijacker); ok {
+				rw = &hijackRecorder{rec}
+			}
+			var body *bodyRecorder
+			if o.IncludeBody && r.Body != nil {
+				body = &bodyRecorder{ReadCloser: r.Body, limit: o.MaxBodyBytes}
+				r.Body = body
+			}
+
+			defer func() {
+				value := recover()
+				if value == nil {
+					if o.StatusThreshold > 0 && rec.Status() >= o.StatusThreshold {
+						count, alert := counter.record(o.ErrorThreshold)
+						if !alert {
+							return
+						}
+						message := fmt.Sprintf("%s %s returned %d", r.Method, r.URL.Path, rec.Status())
+						if o.ErrorThreshold > 1 {
+							message += fmt.Sprintf(" (%d responses at or above %d in the last %s)",
+								count, o.StatusThreshold, formatWindow(o.ErrorWindow))
+						}
+						sendHTTPAlert(logger, &o, r, rec, body, start, message, "", redact)
+					}
+					return
+				}
+				if value == http.ErrAbortHandler {
+					panic(value)
+				}
+
+				err, _ := value.(error)
+				trace := logger.CaptureTrace(types.ERROR, err)
+				if !rec.wroteHeader {
+					http.Error(rec, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+				message := fmt.Sprintf("panic serving %s %s: %v", r.Method, r.URL.Path, value)
+				sendHTTPAlert(logger, &o, r, rec, body, start, message, trace, redact)
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// sendHTTPAlert queues an ERROR alert describing a request and its response, attaching the request
+// dump when headers or the body are captured
+func sendHTTPAlert(logger *Logger, o *HTTPMiddlewareOptions, r *http.Request, rec *statusRecorder, body *bodyRecorder,
+	start time.Time, message, trace string, redact *redactions) {
+	fields := []interface{}{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", rec.Status(),
+		"latency", time.Since(start).Round(time.Millisecond).String(),
+		"client_ip", clientIP(r, o.TrustProxyHeaders),
+	}
+	if o.Route != nil {
+		if route := o.Route(r); route != "" {
+			fields = append(fields, "route", route)
+		}
+	}
+	if id := r.Header.Get(o.RequestIDHeader); id != "" {
+		fields = append(fields, "request_id", id)
+	}
+
+	var attachment *types.Attachment
+	if o.IncludeHeaders || body != nil {
+		attachment = &types.Attachment{FileName: "request.http", Content: dumpRequest(r, o, body, redact)}
+	}
+
+	alert := logger.newAlert(types.ERROR, message, attachment, trace)
+	if !logger.With(fields...).DeliverAsync(context.WithoutCancel(r.Context()), alert, o.Channel) {
+		types.DebugLog(logger.config, "HTTPMiddleware: alert not queued")
+	}
+}
+
+// redactions are the header names, canonicalized, and lowercase query parameters redacted from alerts
+type redactions struct {
+	headers map[string]bool
+	query   map[string]bool
+}
+
+// requestURI returns the request URI with the values of redacted query parameters replaced, keeping
+// the order and encoding of the others
+func (rd *redactions) requestURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		raw, _, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(raw)
+		if err != nil {
+			name = raw
+		}
+		if rd.query[strings.ToLower(name)] {
+			params[i] = raw + "=" + redacted
+		}
+	}
+	uri := *u
+	uri.RawQuery = ""
+	return uri.RequestURI() + "?" + strings.Join(params, "&")
+}
+
+// dumpRequest renders the request line, redacted headers and captured body for an alert attachment
+func dumpRequest(r *http.Request, o *HTTPMiddlewareOptions, body *bodyRecorder, redact *redactions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\n", r.Method, redact.requestURI(r.URL), r.Proto)
+	if o.IncludeHeaders {
+		names := make([]string, 0, len(r.Header))
+		for name := range r.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := strings.Join(r.Header[name], ", ")
+			if redact.headers[http.CanonicalHeaderKey(name)] {
+				value = redacted
+			}
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	if body != nil && body.buf.Len() > 0 {
+		captured := body.buf.Bytes()
+		for _, pattern := range o.RedactBody {
+			captured = pattern.ReplaceAll(captured, []byte(redacted))
+		}
+		b.WriteString("\n")
+		b.Write(captured)
+		if body.truncated {
+			b.WriteString("\n... (truncated)")
+		}
+	}
+	return b.String()
+}
+
+// clientIP returns the client address of a request, from proxy headers when trusted
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher when the underlying writer does
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the status written by the handler, 200 if it wrote none
+func (w *statusRecorder) Status() int {
+	if !w.wroteHeader {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// hijackRecorder is a statusRecorder for writers that support http.Hijacker, e.g. for WebSocket upgrades
+type hijackRecorder struct {
+	*statusRecorder
+}
+
+// Hijack takes over the connection, after which the status is recorded as 101 Switching Protocols
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && !w.wroteHeader {
+		w.status, w.wroteHeader = http.StatusSwitchingProtocols, true
+	}
+	return conn, rw, err
+}
+
+// errorCounter counts responses over the alert threshold in fixed windows
+type errorCounter struct {
+	mu     sync.Mutex
+	window time.Duration
+	start  time.Time
+	count  int
+}
+
+// record counts a response and reports the count in the current window, and whether it reached
+// threshold with this response
+func (c *errorCounter) record(threshold int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.start) >= c.window {
+		c.start, c.count = now, 0
+	}
+	c.count++
+	return c.count, threshold == 1 || c.count == threshold
+}
+
+// bodyRecorder keeps a copy of the first limit bytes of a request body as the handler reads it
+type bodyRecorder struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if room := b.limit - b.buf.Len(); room > 0 {
+			if n > room {
+				b.buf.Write(p[:room])
+				b.truncated = true
+			} else {
+				b.buf.Write(p[:n])
+			}
+		} else {
+			b.truncated = true
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,40 @@
+package providers
+
+import (
+	"fmt"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// loadAlert returns a copy of alert with the content of its Reader attachments read into memory,
+// so that uploads and retries do not depend on the caller's readers
+func loadAlert(alert *types.Alert) (*types.Alert, error) {
+	loaded := *alert
+	if err := loaded.LoadAttachments(); err != nil {
+		return nil, err
+	}
+	return &loaded, nil
+}
+
+// attachmentFileName returns the attachment's file name, or a numbered default
+func attachmentFileName(attachment types.Attachment, index int) string {
+	if attachment.FileName != "" {
+		return attachment.FileName
+	}
+	return fmt.Sprintf("attachment-%d", index+1)
+}
+
+// hasFiles reports whether any attachment of alert carries file content
+func hasFiles(alert *types.Alert) bool {
+	for _, attachment := range alert.Attachments {
+		if attachment.IsFile() {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentError reports attachments that could not be uploaded after the alert itself was delivered
+func attachmentError(provider string, err error) error {
+	return fmt.Errorf("%s alert delivered but attachment upload failed: %w", provider, err)
+}
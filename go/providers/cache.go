@@ -0,0 +1,156 @@
+package providers
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/cache"
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// defaultCacheKeyPrefix namespaces cache keys when Config.CacheKeyPrefix is empty
+const defaultCacheKeyPrefix = "commonlog"
+
+// encryptedValuePrefix marks cache values sealed with Config.CacheEncryptionKey
+const encryptedValuePrefix = "enc:v1:"
+
+// defaultCache is the in-process cache used when neither Cache nor Redis is configured
+var defaultCache types.Cache = cache.NewMemory()
+
+// sharedRedis holds one Redis cache per address set for providers used without a Logger,
+// which otherwise owns and closes its own client
+var (
+	sharedRedisMu sync.Mutex
+	sharedRedis   = make(map[string]*cache.Redis)
+)
+
+// getCache returns the configured cache backend, a shared Redis cache, or the in-process default
+func getCache(cfg types.Config) types.Cache {
+	if cfg.Cache != nil {
+		return cfg.Cache
+	}
+	if cfg.Redis.Client != nil {
+		return cache.NewRedis(cfg.Redis.Client)
+	}
+	opts := cfg.RedisOptions()
+	if opts == nil {
+		return defaultCache
+	}
+	key := fmt.Sprintf("%v|%s|%s|%d", opts.Addrs, opts.MasterName, opts.Username, opts.DB)
+	sharedRedisMu.Lock()
+	defer sharedRedisMu.Unlock()
+	if c, ok := sharedRedis[key]; ok {
+		return c
+	}
+	c := cache.NewRedisFromOptions(opts)
+	sharedRedis[key] = c
+	return c
+}
+
+// cacheKey joins parts under the configured key prefix
+func cacheKey(cfg types.Config, parts ...string) string {
+	prefix := cfg.CacheKeyPrefix
+	if prefix == "" {
+		prefix = defaultCacheKeyPrefix
+	}
+	return prefix + ":" + strings.Join(parts, ":")
+}
+
+// hashCredentials returns a hex SHA-256 digest that identifies credentials without revealing them
+func hashCredentials(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// getCacheWithLegacy reads key, falling back to legacyKey. A value found under legacyKey is moved
+// to key with the given ttl, sealed with sealCacheValue if seal is set, and the legacy entry is
+// deleted. The value returned is the legacy one as stored.
+func getCacheWithLegacy(cfg types.Config, key, legacyKey string, ttl time.Duration, seal bool) (string, bool, error) {
+	c := getCache(cfg)
+	ctx := context.Background()
+	value, found, err := c.Get(ctx, key)
+	if err != nil || found {
+		return value, found, err
+	}
+	value, found, err = c.Get(ctx, legacyKey)
+	if err != nil || !found {
+		return "", false, err
+	}
+	types.DebugLog(cfg, "getCacheWithLegacy: migrating legacy cache entry")
+	migrated := value
+	if seal {
+		// Legacy entries were never encrypted; keep them out of the new key rather than store them in the clear
+		if migrated, err = sealCacheValue(cfg, value); err != nil {
+			types.DebugLog(cfg, "getCacheWithLegacy: failed to seal legacy cache entry: %v", err)
+			return value, true, nil
+		}
+	}
+	if err := c.Set(ctx, key, migrated, ttl); err != nil {
+		types.DebugLog(cfg, "getCacheWithLegacy: failed to migrate legacy cache entry: %v", err)
+	} else if err := c.Delete(ctx, legacyKey); err != nil {
+		types.DebugLog(cfg, "getCacheWithLegacy: failed to delete legacy cache entry: %v", err)
+	}
+	return value, true, nil
+}
+
+// sealCacheValue encrypts value with AES-GCM when CacheEncryptionKey is set, otherwise returns it unchanged
+func sealCacheValue(cfg types.Config, value string) (string, error) {
+	if len(cfg.CacheEncryptionKey) == 0 {
+		return value, nil
+	}
+	gcm, err := newCacheCipher(cfg.CacheEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openCacheValue decrypts a value sealed by sealCacheValue. Unencrypted values are returned
+// unchanged so that entries written before encryption was enabled remain readable.
+func openCacheValue(cfg types.Config, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+	if len(cfg.CacheEncryptionKey) == 0 {
+		return "", fmt.Errorf("cache value is encrypted but no CacheEncryptionKey is configured")
+	}
+	gcm, err := newCacheCipher(cfg.CacheEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted cache value is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cache value: %w", err)
+	}
+	return string(plain), nil
+}
+
+func newCacheCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CacheEncryptionKey: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,49 @@
+package providers
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup deduplicates concurrent calls that share a key: while a call is in flight,
+// later callers with the same key wait for it and receive its result instead of repeating it
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  string
+	err  error
+}
+
+// Do runs fn once per key among concurrent callers and returns its result to all of them.
+// A waiting caller returns early with its ctx's error when ctx is done; fn itself runs with the
+// context of the caller that started it.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() (string, error)) (string, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.val, c.err
+}
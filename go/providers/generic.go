@@ -0,0 +1,132 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// GenericProvider implements Provider by POSTing each alert as a JSON document to an HTTP endpoint,
+// for receivers that have no dedicated provider. The token field contains the endpoint URL.
+type GenericProvider struct{}
+
+// genericAttachment is the JSON form of an attachment; file content is base64-encoded in Data
+type genericAttachment struct {
+	URL         string `json:"url,omitempty"`
+	FileName    string `json:"file_name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// genericPayload is the JSON document delivered by GenericProvider
+type genericPayload struct {
+	Service     string                 `json:"service,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Level       types.Level            `json:"level"`
+	Severity    string                 `json:"severity"`
+	Title       string                 `json:"title,omitempty"`
+	Message     string                 `json:"message"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Attachments []genericAttachment    `json:"attachments,omitempty"`
+	Trace       string                 `json:"trace,omitempty"`
+	DedupKey    string                 `json:"dedup_key,omitempty"`
+	Labels      map[string]string      `json:"labels,omitempty"`
+	ThreadRef   *types.MessageRef      `json:"thread_ref,omitempty"`
+	Channel     string                 `json:"channel,omitempty"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+// Deliver POSTs the alert to the endpoint. The endpoint does not report message references, so
+// replacing a delivered message is not supported.
+func (p *GenericProvider) Deliver(ctx context.Context, alert *types.Alert, target types.Target) (*types.DeliveryResult, error) {
+	cfg := target.Config
+	types.DebugLog(cfg, "GenericProvider.Deliver called with level: %s, channel: %s", alert.Level, target.Channel)
+
+	if target.Replace != nil {
+		return nil, fmt.Errorf("the generic provider does not support message updates")
+	}
+	alert, err := loadAlert(alert)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := cfg.Token
+	if endpoint == "" {
+		err := fmt.Errorf("endpoint URL is required for the generic provider")
+		types.DebugLog(cfg, "Error: %v", err)
+		return nil, err
+	}
+
+	timestamp := alert.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	payload := genericPayload{
+		Service:     cfg.ServiceName,
+		Environment: cfg.Environment,
+		Level:       alert.Level,
+		Severity:    alert.Level.PagerDutySeverity(),
+		Title:       alert.Title,
+		Message:     alert.Message,
+		Fields:      alert.Fields,
+		Trace:       alert.Trace,
+		DedupKey:    alert.DedupKey,
+		Labels:      alert.Labels,
+		ThreadRef:   alert.ThreadRef,
+		Channel:     target.Channel,
+		Timestamp:   timestamp.UTC(),
+	}
+	for _, attachment := range alert.Attachments {
+		payload.Attachments = append(payload.Attachments, genericAttachment{
+			URL:         attachment.URL,
+			FileName:    attachment.FileName,
+			ContentType: attachment.MIMEType(),
+			Size:        attachment.Size,
+			Content:     attachment.Content,
+			Data:        attachment.Data,
+		})
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		types.DebugLog(cfg, "GenericProvider.Deliver: failed to encode payload: %v", err)
+		return nil, err
+	}
+	types.DebugLog(cfg, "GenericProvider.Deliver: payload prepared, size: %d bytes", len(data))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := cfg.DoHTTP(req)
+	if err != nil {
+		types.DebugLog(cfg, "GenericProvider.Deliver: HTTP request failed: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := &types.HTTPStatusError{Source: "generic provider", StatusCode: resp.StatusCode}
+		types.DebugLog(cfg, "GenericProvider.Deliver: error response: %v", err)
+		return nil, err
+	}
+	types.DebugLog(cfg, "GenericProvider.Deliver: alert delivered successfully")
+	return &types.DeliveryResult{Provider: "generic", Channel: target.Channel}, nil
+}
+
+func (p *GenericProvider) Send(level types.Level, message string, attachment *types.Attachment, cfg types.Config) error {
+	return p.SendToChannel(level, message, attachment, cfg, cfg.Channel)
+}
+
+func (p *GenericProvider) SendToChannel(level types.Level, message string, attachment *types.Attachment, cfg types.Config, channel string) error {
+	_, err := p.Deliver(context.Background(), types.NewAlert(level, message, attachment, cfg), types.Target{Channel: channel, Config: cfg})
+	return err
+}
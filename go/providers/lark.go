@@ -5,373 +5,421 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/alvianhanif/commonlog/go/types"
-
-	redis "github.com/go-redis/redis/v8"
 )
 
-// getRedisClient returns a Redis client using host/port from cfg, env, or default
-func getRedisClient(cfg types.Config) (*redis.Client, error) {
-	host := cfg.RedisHost
-	port := cfg.RedisPort
-	fmt.Printf("[Lark] Initializing Redis client with host: '%s', port: '%s'\n", host, port)
-	if host == "" || port == "" {
-		fmt.Printf("[Lark] RedisHost and RedisPort must be set in commonlog config\n")
-		return nil, fmt.Errorf("RedisHost and RedisPort must be set in commonlog config")
-	}
-	addr := host + ":" + port
-	fmt.Printf("[Lark] Connecting to Redis at address: %s\n", addr)
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-		DB:   0,
-	})
-	ctx := context.Background()
-	if err := client.Ping(ctx).Err(); err != nil {
-		fmt.Printf("[Lark] Failed to ping Redis at %s: %v\n", addr, err)
-		return nil, fmt.Errorf("failed to ping Redis: %w", err)
-	}
-	fmt.Printf("[Lark] Successfully connected to Redis at %s\n", addr)
-	return client, nil
+// LarkProvider implements Provider for Lark. The zero value is ready to use; it keeps tenant access
+// tokens in memory and refreshes them in the background until Close is called.
+type LarkProvider struct {
+	mu            sync.Mutex
+	tokens        map[string]*larkToken
+	flight        flightGroup
+	closed        bool
+	refreshCtx    context.Context // background token refreshes, cancelled by Close
+	cancelRefresh context.CancelFunc
 }
 
-func cacheLarkToken(cfg types.Config, appID, appSecret, token string) error {
-	key := "commonlog_lark_token:" + appID + ":" + appSecret
-	client, err := getRedisClient(cfg)
+// Deliver sends an alert, replies in the thread of alert.ThreadRef, or edits target.Replace in place.
+// Webhook deliveries return no message reference because Lark does not report the message_id for
+// incoming webhooks.
+func (p *LarkProvider) Deliver(ctx context.Context, alert *types.Alert, target types.Target) (*types.DeliveryResult, error) {
+	cfg := target.Config
+	cfg.Channel = target.Channel
+	types.DebugLog(cfg, "LarkProvider.Deliver called with level: %s, send method: %s, channel: %s",
+		alert.Level, cfg.SendMethod, cfg.Channel)
+	alert, err := loadAlert(alert)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return client.Set(context.Background(), key, token, 90*time.Minute).Err()
-}
 
-func cacheChatID(cfg types.Config, channelName, chatID string) error {
-	key := "commonlog_lark_chat_id:" + cfg.Environment + ":" + channelName
-	client, err := getRedisClient(cfg)
-	if err != nil {
-		return err
+	if target.Replace != nil {
+		return p.updateLarkMessage(ctx, alert, target.Replace, cfg)
 	}
-	return client.Set(context.Background(), key, chatID, 0).Err() // No expiry
-}
-
-func getCachedLarkToken(cfg types.Config, appID, appSecret string) (string, error) {
-	key := "commonlog_lark_token:" + appID + ":" + appSecret
-	client, err := getRedisClient(cfg)
-	if err != nil {
-		return "", err
+	if alert.ThreadRef != nil {
+		return p.replyLarkThread(ctx, alert, alert.ThreadRef, cfg)
 	}
-	result, err := client.Get(context.Background(), key).Result()
-	if err == redis.Nil {
-		fmt.Printf("[Lark] No cached token found for key: %s\n", key)
-		return "", nil // No cached token
-	} else if err != nil {
-		fmt.Printf("[Lark] Error retrieving cached token for key %s: %v\n", key, err)
-		return "", err
+	switch cfg.SendMethod {
+	case types.MethodWebClient:
+		types.DebugLog(cfg, "Using Lark webclient method")
+		return p.sendLarkWebClient(ctx, alert, cfg)
+	case types.MethodWebhook:
+		types.DebugLog(cfg, "Using Lark webhook method")
+		if err := p.sendLarkWebhook(ctx, alert, cfg); err != nil {
+			return nil, err
+		}
+		return &types.DeliveryResult{Provider: "lark", Channel: cfg.Channel}, nil
+	default:
+		err := fmt.Errorf("unknown send method for Lark: %s", cfg.SendMethod)
+		types.DebugLog(cfg, "Error: %v", err)
+		return nil, err
 	}
-	fmt.Printf("[Lark] Retrieved cached token for key: %s\n", key)
-	return result, nil
 }
 
-func getCachedChatID(cfg types.Config, channelName string) (string, error) {
-	key := "commonlog_lark_chat_id:" + cfg.Environment + ":" + channelName
-	client, err := getRedisClient(cfg)
-	if err != nil {
-		return "", err
-	}
-	result, err := client.Get(context.Background(), key).Result()
-	if err == redis.Nil {
-		fmt.Printf("[Lark] No cached chat_id found for channel: %s in environment: %s\n", channelName, cfg.Environment)
-		return "", nil // No cached chat_id
-	} else if err != nil {
-		fmt.Printf("[Lark] Error retrieving cached chat_id for channel %s in environment %s: %v\n", channelName, cfg.Environment, err)
-		return "", err
+func (p *LarkProvider) Send(level types.Level, message string, attachment *types.Attachment, cfg types.Config) error {
+	return p.SendToChannel(level, message, attachment, cfg, cfg.Channel)
+}
+
+func (p *LarkProvider) SendToChannel(level types.Level, message string, attachment *types.Attachment, cfg types.Config, channel string) error {
+	_, err := p.SendWithRef(level, message, attachment, cfg, channel)
+	return err
+}
+
+// SendWithRef sends a message and returns a reference to it. Webhook sends return a nil reference.
+func (p *LarkProvider) SendWithRef(level types.Level, message string, attachment *types.Attachment, cfg types.Config, channel string) (*types.MessageRef, error) {
+	result, err := p.Deliver(context.Background(), types.NewAlert(level, message, attachment, cfg), types.Target{Channel: channel, Config: cfg})
+	if result == nil {
+		return nil, err
 	}
-	fmt.Printf("[Lark] Retrieved cached chat_id for channel: %s in environment: %s\n", channelName, cfg.Environment)
-	return result, nil
+	return result.Ref, err
 }
 
-// getChatIDFromChannelName fetches the chat_id for a given channel name using pagination
-func getChatIDFromChannelName(cfg types.Config, token, channelName string) (string, error) {
-	// Try Redis cache first
-	cached, err := getCachedChatID(cfg, channelName)
-	if err != nil {
-		return "", fmt.Errorf("failed to get Redis client: %w", err)
+// Reply posts a message in the thread of a previously delivered message
+func (p *LarkProvider) Reply(ref *types.MessageRef, level types.Level, message string, attachment *types.Attachment, cfg types.Config) (*types.MessageRef, error) {
+	if ref == nil {
+		return nil, checkLarkRef(ref, cfg)
 	}
-	if cached != "" {
-		return cached, nil
+	alert := types.NewAlert(level, message, attachment, cfg)
+	alert.ThreadRef = ref
+	result, err := p.Deliver(context.Background(), alert, types.Target{Channel: ref.Channel, Config: cfg})
+	if result == nil {
+		return nil, err
 	}
+	return result.Ref, err
+}
 
-	baseURL := "https://open.larksuite.com/open-apis/im/v1/chats"
-	headers := map[string]string{"Authorization": "Bearer " + token}
-
-	pageToken := ""
-	hasMore := true
-
-	for hasMore {
-		url := baseURL + "?page_size=10"
-		if pageToken != "" {
-			url += "&page_token=" + pageToken
-		}
-
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return "", err
-		}
-		for k, v := range headers {
-			req.Header.Set(k, v)
-		}
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return "", err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			return "", fmt.Errorf("lark chats API response: %d", resp.StatusCode)
-		}
-
-		var result struct {
-			Code int    `json:"code"`
-			Msg  string `json:"msg"`
-			Data struct {
-				Items []struct {
-					ChatID string `json:"chat_id"`
-					Name   string `json:"name"`
-				} `json:"items"`
-				PageToken string `json:"page_token"`
-				HasMore   bool   `json:"has_more"`
-			} `json:"data"`
-		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return "", err
-		}
-
-		if result.Code != 0 {
-			return "", fmt.Errorf("lark API error: %s", result.Msg)
-		}
-
-		// Search for the channel name in the current page
-		for _, item := range result.Data.Items {
-			if item.Name == channelName {
-				// Cache the chat_id without expiry
-				if err := cacheChatID(cfg, channelName, item.ChatID); err != nil {
-					fmt.Printf("[Lark] Warning: failed to cache chat_id for channel %s: %v\n", channelName, err)
-				}
-				return item.ChatID, nil
-			}
-		}
-
-		// Update pagination info
-		pageToken = result.Data.PageToken
-		hasMore = result.Data.HasMore
+// Update replaces the content of a previously delivered message
+func (p *LarkProvider) Update(ref *types.MessageRef, level types.Level, message string, attachment *types.Attachment, cfg types.Config) error {
+	if ref == nil {
+		return checkLarkRef(ref, cfg)
 	}
-
-	return "", fmt.Errorf("channel '%s' not found", channelName)
+	_, err := p.Deliver(context.Background(), types.NewAlert(level, message, attachment, cfg), types.Target{Channel: ref.Channel, Config: cfg, Replace: ref})
+	return err
 }
 
-// LarkProvider implements Provider for Lark
-type LarkProvider struct{}
-
-func getTenantAccessToken(cfg types.Config, appID, appSecret string) (string, error) {
-	// Try Redis cache first
-	cached, err := getCachedLarkToken(cfg, appID, appSecret)
-	if err != nil {
-		return "", fmt.Errorf("failed to get Redis client: %w", err)
+// replyLarkThread posts the alert in the thread of a previously delivered message
+func (p *LarkProvider) replyLarkThread(ctx context.Context, alert *types.Alert, ref *types.MessageRef, cfg types.Config) (*types.DeliveryResult, error) {
+	types.DebugLog(cfg, "replyLarkThread called with level: %s, send method: %s", alert.Level, cfg.SendMethod)
+	if err := checkLarkRef(ref, cfg); err != nil {
+		return nil, err
 	}
-	if cached != "" {
-		return cached, nil
+
+	content, _ := json.Marshal(p.buildCard(alert, cfg))
+	payload := map[string]interface{}{
+		"msg_type":        "interactive",
+		"content":         string(content),
+		"reply_in_thread": true,
 	}
-	url := "https://open.larksuite.com/open-apis/auth/v3/tenant_access_token/internal"
-	payload := map[string]string{"app_id": appID, "app_secret": appSecret}
-	data, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	if err != nil {
-		return "", err
+	url := cfg.LarkToken.APIBaseURL() + "/im/v1/messages/" + ref.MessageID + "/reply"
+
+	var data struct {
+		MessageID string `json:"message_id"`
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	err := p.withLarkToken(ctx, cfg, func(token string) error {
+		return doLarkRequestContext(ctx, cfg, "POST", url, token, payload, &data)
+	})
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	var result struct {
-		Code   int    `json:"code"`
-		Msg    string `json:"msg"`
-		Token  string `json:"tenant_access_token"`
-		Expire int    `json:"expire"`
+		types.DebugLog(cfg, "replyLarkThread: request failed: %v", err)
+		return nil, err
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+	types.DebugLog(cfg, "replyLarkThread: reply sent successfully")
+	result := larkDeliveryResult(ref.Channel, data.MessageID)
+	if err := p.uploadLarkFiles(ctx, cfg, alert, data.MessageID); err != nil {
+		return result, attachmentError("lark", err)
 	}
-	if result.Code != 0 {
-		return "", fmt.Errorf("lark token error: %s", result.Msg)
+	return result, nil
+}
+
+// updateLarkMessage replaces the card of a previously delivered message
+func (p *LarkProvider) updateLarkMessage(ctx context.Context, alert *types.Alert, ref *types.MessageRef, cfg types.Config) (*types.DeliveryResult, error) {
+	types.DebugLog(cfg, "updateLarkMessage called with level: %s, send method: %s", alert.Level, cfg.SendMethod)
+	if err := checkLarkRef(ref, cfg); err != nil {
+		return nil, err
 	}
-	// Cache the token for (expire - 10 minutes)
-	expireSeconds := result.Expire - 600
-	if expireSeconds <= 0 {
-		expireSeconds = 60 // fallback to 1 minute if API returns too low
+
+	if hasFiles(alert) {
+		types.DebugLog(cfg, "updateLarkMessage: file attachments are not uploaded when updating a message")
 	}
-	key := "commonlog_lark_token:" + appID + ":" + appSecret
-	client, err := getRedisClient(cfg)
-	if err != nil {
-		return "", fmt.Errorf("failed to get Redis client: %w", err)
+	content, _ := json.Marshal(p.buildCard(alert, cfg))
+	// Cards are edited in place with PATCH; the payload carries only the new card
+	payload := map[string]interface{}{
+		"content": string(content),
 	}
-	err = client.Set(context.Background(), key, result.Token, time.Duration(expireSeconds)*time.Second).Err()
+	url := cfg.LarkToken.APIBaseURL() + "/im/v1/messages/" + ref.MessageID
+
+	err := p.withLarkToken(ctx, cfg, func(token string) error {
+		return doLarkRequestContext(ctx, cfg, "PATCH", url, token, payload, nil)
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to cache token: %w", err)
+		types.DebugLog(cfg, "updateLarkMessage: request failed: %v", err)
+		return nil, err
 	}
-	return result.Token, nil
+	types.DebugLog(cfg, "updateLarkMessage: message updated successfully")
+	return larkDeliveryResult(ref.Channel, ref.MessageID), nil
 }
 
-func (p *LarkProvider) Send(level int, message string, attachment *types.Attachment, cfg types.Config) error {
-	return p.SendToChannel(level, message, attachment, cfg, cfg.Channel)
+// larkDeliveryResult builds a delivery result referencing a message in channel
+func larkDeliveryResult(channel, messageID string) *types.DeliveryResult {
+	return &types.DeliveryResult{
+		Provider: "lark",
+		Channel:  channel,
+		Ref:      &types.MessageRef{Provider: "lark", Channel: channel, MessageID: messageID},
+	}
 }
 
-func (p *LarkProvider) SendToChannel(level int, message string, attachment *types.Attachment, cfg types.Config, channel string) error {
-	types.DebugLog(cfg, "LarkProvider.SendToChannel called with level: %d, send method: %s, channel: %s",
-		level, cfg.SendMethod, channel)
-
-	cfgCopy := cfg
-	cfgCopy.Channel = channel
-	switch cfgCopy.SendMethod {
-	case types.MethodWebClient:
-		types.DebugLog(cfg, "Using Lark webclient method")
-		return p.sendLarkWebClient(message, attachment, cfgCopy)
-	case types.MethodWebhook:
-		types.DebugLog(cfg, "Using Lark webhook method")
-		return p.sendLarkWebhook(message, attachment, cfgCopy)
-	default:
-		err := fmt.Errorf("unknown send method for Lark: %s", cfgCopy.SendMethod)
-		types.DebugLog(cfg, "Error: %v", err)
-		return err
+// checkLarkRef validates that a message reference can be used with the Lark webclient method
+func checkLarkRef(ref *types.MessageRef, cfg types.Config) error {
+	if cfg.SendMethod != types.MethodWebClient {
+		return fmt.Errorf("lark replies and updates require the webclient send method")
 	}
+	if ref == nil || ref.MessageID == "" {
+		return fmt.Errorf("lark message reference is missing a message_id")
+	}
+	return nil
 }
 
-// formatMessage formats the alert message with optional attachment and returns title and content separately
-func (p *LarkProvider) formatMessage(message string, attachment *types.Attachment, cfg types.Config) (string, string) {
-	// Extract title from service and environment
-	title := "Alert"
-	if cfg.ServiceName != "" && cfg.Environment != "" {
-		title = fmt.Sprintf("%s - %s", cfg.ServiceName, cfg.Environment)
-	} else if cfg.ServiceName != "" {
-		title = cfg.ServiceName
-	} else if cfg.Environment != "" {
-		title = cfg.Environment
+// formatMessage formats the alert with its inline attachments and trace and returns title and content separately
+func (p *LarkProvider) formatMessage(alert *types.Alert, cfg types.Config) (string, string) {
+	// Build title from level and the alert title
+	title := alert.TitleOrDefault(cfg)
+	if title == "" {
+		title = "Alert"
 	}
+	title = fmt.Sprintf("%s [%s] %s", alert.Level.Emoji(), alert.Level, title)
 
 	// Format message content without the header
-	formatted := message
+	formatted := alert.Message
 
-	if attachment != nil {
+	for i, attachment := range alert.AllAttachments() {
 		if attachment.Content != "" {
 			// Inline content - show as expandable code block
-			filename := attachment.FileName
-			if filename == "" {
-				filename = "Trace Logs"
-			}
-			formatted += fmt.Sprintf("\n\n**%s:**\n```\n%s\n```", filename, attachment.Content)
+			formatted += fmt.Sprintf("\n\n**%s:**\n```\n%s\n```", attachmentFileName(attachment, i), attachment.Content)
 		}
 		if attachment.URL != "" {
 			// External URL attachment
 			formatted += fmt.Sprintf("\n\n**Attachment:** %s", attachment.URL)
 		}
+		if attachment.IsFile() && cfg.SendMethod != types.MethodWebClient {
+			// Webhooks cannot upload files, so only name them
+			formatted += fmt.Sprintf("\n\n**Attachment:** %s (%s, %d bytes, not uploaded by webhooks)",
+				attachmentFileName(attachment, i), attachment.MIMEType(), attachment.Size)
+		}
 	}
 
 	return title, formatted
 }
 
-func (p *LarkProvider) sendLarkWebClient(message string, attachment *types.Attachment, cfg types.Config) error {
-	types.DebugLog(cfg, "sendLarkWebClient: formatting message and preparing API request")
-	title, formattedMessage := p.formatMessage(message, attachment, cfg)
-	token := cfg.Token
+// buildCard formats the alert as an interactive card
+func (p *LarkProvider) buildCard(alert *types.Alert, cfg types.Config) map[string]interface{} {
+	title, formattedMessage := p.formatMessage(alert, cfg)
+	return larkCardContent(alert.Level, title, formattedMessage, alert.Fields)
+}
 
-	types.DebugLog(cfg, "sendLarkWebClient: sending to channel '%s'", cfg.Channel)
+// larkCardTemplates maps levels to Lark card header colors
+var larkCardTemplates = map[types.Level]string{
+	types.DEBUG:    "grey",
+	types.INFO:     "blue",
+	types.NOTICE:   "turquoise",
+	types.WARN:     "orange",
+	types.ERROR:    "red",
+	types.CRITICAL: "carmine",
+	types.FATAL:    "purple",
+}
 
-	// Use LarkToken if available, otherwise fall back to Token parsing
-	var appID, appSecret string
-	if cfg.LarkToken.AppID != "" && cfg.LarkToken.AppSecret != "" {
-		appID = cfg.LarkToken.AppID
-		appSecret = cfg.LarkToken.AppSecret
-		types.DebugLog(cfg, "sendLarkWebClient: fetching tenant access token for appID (length: %d)", len(appID))
-		fetched, err := getTenantAccessToken(cfg, appID, appSecret)
-		if err != nil {
-			types.DebugLog(cfg, "sendLarkWebClient: error fetching tenant access token: %v", err)
-			return err
+// larkCardContent builds the interactive card shared by webclient and webhook messages: a header
+// colored by level, the body as markdown and the structured fields as short div fields
+func larkCardContent(level types.Level, title, text string, fields map[string]interface{}) map[string]interface{} {
+	template, ok := larkCardTemplates[level]
+	if !ok {
+		template = "blue"
+	}
+	elements := []interface{}{
+		map[string]interface{}{
+			"tag":     "markdown",
+			"content": text,
+		},
+	}
+	if len(fields) > 0 {
+		var divFields []interface{}
+		for _, key := range types.SortedFieldKeys(fields) {
+			divFields = append(divFields, map[string]interface{}{
+				"is_short": true,
+				"text": map[string]interface{}{
+					"tag":     "lark_md",
+					"content": fmt.Sprintf("**%s**\n%v", key, fields[key]),
+				},
+			})
 		}
-		token = fetched
-		types.DebugLog(cfg, "sendLarkWebClient: tenant access token fetched successfully")
+		elements = append(elements, map[string]interface{}{
+			"tag":    "div",
+			"fields": divFields,
+		})
+	}
+	return map[string]interface{}{
+		// update_multi makes the card shared, which Lark requires for it to be updated with PATCH
+		"config": map[string]interface{}{"wide_screen_mode": true, "update_multi": true},
+		"header": map[string]interface{}{
+			"title":    map[string]interface{}{"tag": "plain_text", "content": title},
+			"template": template,
+		},
+		"elements": elements,
+	}
+}
+
+// parseLarkReceiver splits a "<type>:<id>" channel into its receive_id_type and ID.
+// ok is false when the channel does not start with a known receive_id_type.
+func parseLarkReceiver(channel string) (idType, id string, ok bool) {
+	idType, id, found := strings.Cut(channel, ":")
+	if !found || id == "" {
+		return "", "", false
+	}
+	switch idType {
+	case types.LarkReceiveChatID, types.LarkReceiveOpenID, types.LarkReceiveUserID,
+		types.LarkReceiveUnionID, types.LarkReceiveEmail:
+		return idType, id, true
+	}
+	return "", "", false
+}
+
+// resolveLarkReceiver returns the receive_id_type and receive_id for a channel,
+// looking up the chat_id by name unless the channel addresses a receiver directly
+func (p *LarkProvider) resolveLarkReceiver(ctx context.Context, cfg types.Config, token, channel string) (string, string, error) {
+	if idType, id, ok := parseLarkReceiver(channel); ok {
+		types.DebugLog(cfg, "resolveLarkReceiver: using receive_id_type '%s' without chat lookup", idType)
+		return idType, id, nil
 	}
 
 	// Get chat_id from channel name
-	types.DebugLog(cfg, "sendLarkWebClient: resolving chat_id for channel '%s'", cfg.Channel)
-	chatID, err := getChatIDFromChannelName(cfg, token, cfg.Channel)
+	types.DebugLog(cfg, "resolveLarkReceiver: resolving chat_id for channel '%s'", channel)
+	chatID, err := p.getChatIDFromChannelName(ctx, cfg, token, channel)
 	if err != nil {
-		types.DebugLog(cfg, "sendLarkWebClient: failed to get chat_id for channel '%s': %v", cfg.Channel, err)
-		return fmt.Errorf("failed to get chat_id for channel '%s': %v", cfg.Channel, err)
+		types.DebugLog(cfg, "resolveLarkReceiver: failed to get chat_id for channel '%s': %v", channel, err)
+		return "", "", fmt.Errorf("failed to get chat_id for channel '%s': %w", channel, err)
 	}
-	types.DebugLog(cfg, "sendLarkWebClient: resolved chat_id (length: %d)", len(chatID))
+	types.DebugLog(cfg, "resolveLarkReceiver: resolved chat_id (length: %d)", len(chatID))
+	return types.LarkReceiveChatID, chatID, nil
+}
 
-	url := "https://open.larksuite.com/open-apis/im/v1/messages?receive_id_type=chat_id"
-	headers := map[string]string{"Authorization": "Bearer " + token, "Content-Type": "application/json"}
+// doLarkRequest sends an authenticated JSON request to the Lark open API and decodes the
+// "data" field of the response envelope into out, if out is non-nil
+func doLarkRequest(cfg types.Config, method, url, token string, payload interface{}, out interface{}) error {
+	return doLarkRequestContext(context.Background(), cfg, method, url, token, payload, out)
+}
 
-	payload := map[string]interface{}{
-		"receive_id": chatID,
-		"msg_type":   "post",
-		"content": map[string]interface{}{
-			"post": map[string]interface{}{
-				"zh_cn": map[string]interface{}{
-					"title": title,
-					"content": []interface{}{
-						[]interface{}{
-							map[string]interface{}{
-								"tag":  "text",
-								"text": formattedMessage,
-							},
-						},
-					},
-				},
-			},
-		},
+// doLarkRequestContext is doLarkRequest with a caller-supplied context
+func doLarkRequestContext(ctx context.Context, cfg types.Config, method, url, token string, payload interface{}, out interface{}) error {
+	if payload == nil {
+		types.DebugLog(cfg, "doLarkRequest: %s %s", method, url)
+		return doLarkRawRequest(ctx, cfg, method, url, token, "", nil, out)
 	}
 	data, _ := json.Marshal(payload)
+	types.DebugLog(cfg, "doLarkRequest: %s %s, payload size: %d bytes", method, url, len(data))
+	return doLarkRawRequest(ctx, cfg, method, url, token, "application/json", bytes.NewBuffer(data), out)
+}
 
-	types.DebugLog(cfg, "sendLarkWebClient: sending HTTP request to Lark API, payload size: %d bytes, payload: %s", len(data), string(data))
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	for k, v := range headers {
-		req.Header.Set(k, v)
+// doLarkRawRequest sends an authenticated request with a body of the given content type and
+// decodes the response envelope like doLarkRequest
+func doLarkRawRequest(ctx context.Context, cfg types.Config, method, url, token, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.DoHTTP(req)
 	if err != nil {
-		types.DebugLog(cfg, "sendLarkWebClient: HTTP request failed: %v", err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	// Log response data
 	respBody := new(bytes.Buffer)
-	_, copyErr := respBody.ReadFrom(resp.Body)
-	if copyErr != nil {
-		types.DebugLog(cfg, "sendLarkWebClient: error reading response body: %v", copyErr)
-	} else {
-		types.DebugLog(cfg, "sendLarkWebClient: response status: %d, body length: %d, body: %s", resp.StatusCode, respBody.Len(), respBody.String())
+	if _, err := respBody.ReadFrom(resp.Body); err != nil {
+		return err
+	}
+	types.DebugLog(cfg, "doLarkRequest: response status: %d, body length: %d, body: %s", resp.StatusCode, respBody.Len(), respBody.String())
+	// Throttling and server errors carry an envelope too, e.g. 429 with code 99991400, but must
+	// stay transient for the circuit breaker and spool
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return &types.HTTPStatusError{Source: "lark API", StatusCode: resp.StatusCode}
 	}
 
-	if resp.StatusCode != 200 {
-		err := fmt.Errorf("lark WebClient response: %d", resp.StatusCode)
-		types.DebugLog(cfg, "sendLarkWebClient: error response: %v", err)
+	var result struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(respBody.Bytes(), &result); err != nil {
+		if resp.StatusCode != 200 {
+			return &types.HTTPStatusError{Source: "lark API", StatusCode: resp.StatusCode}
+		}
 		return err
 	}
-	types.DebugLog(cfg, "sendLarkWebClient: message sent successfully to channel '%s'", cfg.Channel)
+	if result.Code != 0 {
+		return &larkAPIError{Code: result.Code, Msg: result.Msg}
+	}
+	if resp.StatusCode != 200 {
+		return &types.HTTPStatusError{Source: "lark API", StatusCode: resp.StatusCode}
+	}
+	if out != nil && len(result.Data) > 0 {
+		return json.Unmarshal(result.Data, out)
+	}
 	return nil
 }
 
-func (p *LarkProvider) sendLarkWebhook(message string, attachment *types.Attachment, cfg types.Config) error {
+func (p *LarkProvider) sendLarkWebClient(ctx context.Context, alert *types.Alert, cfg types.Config) (*types.DeliveryResult, error) {
+	types.DebugLog(cfg, "sendLarkWebClient: formatting message and preparing API request")
+	types.DebugLog(cfg, "sendLarkWebClient: sending to channel '%s'", cfg.Channel)
+
+	// The messages API expects content as a JSON-encoded string
+	content, _ := json.Marshal(p.buildCard(alert, cfg))
+
+	var data struct {
+		MessageID string `json:"message_id"`
+	}
+	send := func(token string) error {
+		idType, receiveID, err := p.resolveLarkReceiver(ctx, cfg, token, cfg.Channel)
+		if err != nil {
+			return err
+		}
+		url := cfg.LarkToken.APIBaseURL() + "/im/v1/messages?receive_id_type=" + idType
+		payload := map[string]interface{}{
+			"receive_id": receiveID,
+			"msg_type":   "interactive",
+			"content":    string(content),
+		}
+		return doLarkRequestContext(ctx, cfg, "POST", url, token, payload, &data)
+	}
+	err := p.withLarkToken(ctx, cfg, func(token string) error {
+		err := send(token)
+		if _, _, direct := parseLarkReceiver(cfg.Channel); direct || !isLarkErrorCode(err, larkChatGoneCodes...) {
+			return err
+		}
+		// The cached chat_id is stale, e.g. the chat was renamed or the bot left; look it up again
+		types.DebugLog(cfg, "sendLarkWebClient: chat_id for channel '%s' rejected, invalidating and retrying: %v", cfg.Channel, err)
+		invalidateChatID(cfg, cfg.Channel)
+		return send(token)
+	})
+	if err != nil {
+		types.DebugLog(cfg, "sendLarkWebClient: error response: %v", err)
+		return nil, err
+	}
+	types.DebugLog(cfg, "sendLarkWebClient: message sent successfully to channel '%s', message_id: %s", cfg.Channel, data.MessageID)
+	result := larkDeliveryResult(cfg.Channel, data.MessageID)
+	if err := p.uploadLarkFiles(ctx, cfg, alert, data.MessageID); err != nil {
+		return result, attachmentError("lark", err)
+	}
+	return result, nil
+}
+
+func (p *LarkProvider) sendLarkWebhook(ctx context.Context, alert *types.Alert, cfg types.Config) error {
 	types.DebugLog(cfg, "sendLarkWebhook: formatting message and preparing webhook request")
-	title, formattedMessage := p.formatMessage(message, attachment, cfg)
 
 	// For webhook, the token field contains the webhook URL
 	webhookURL := cfg.Token
@@ -383,32 +431,21 @@ func (p *LarkProvider) sendLarkWebhook(message string, attachment *types.Attachm
 	types.DebugLog(cfg, "sendLarkWebhook: using webhook URL (length: %d)", len(webhookURL))
 
 	payload := map[string]interface{}{
-		"msg_type": "post",
-		"content": map[string]interface{}{
-			"post": map[string]interface{}{
-				"zh_cn": map[string]interface{}{
-					"title": title,
-					"content": []interface{}{
-						[]interface{}{
-							map[string]interface{}{
-								"tag":  "text",
-								"text": formattedMessage,
-							},
-						},
-					},
-				},
-			},
-		},
+		"msg_type": "interactive",
+		"card":     p.buildCard(alert, cfg),
 	}
 
 	data, _ := json.Marshal(payload)
 	types.DebugLog(cfg, "sendLarkWebhook: payload prepared, size: %d bytes, payload: %s", len(data), string(data))
 
-	req, _ := http.NewRequest("POST", webhookURL, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	types.DebugLog(cfg, "sendLarkWebhook: sending HTTP request to webhook URL")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.DoHTTP(req)
 	if err != nil {
 		types.DebugLog(cfg, "sendLarkWebhook: HTTP request failed: %v", err)
 		return err
@@ -425,7 +462,7 @@ func (p *LarkProvider) sendLarkWebhook(message string, attachment *types.Attachm
 	}
 
 	if resp.StatusCode != 200 {
-		err := fmt.Errorf("lark webhook response: %d", resp.StatusCode)
+		err := &types.HTTPStatusError{Source: "lark webhook", StatusCode: resp.StatusCode}
 		types.DebugLog(cfg, "sendLarkWebhook: error response: %v", err)
 		return err
 	}
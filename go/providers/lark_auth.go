@@ -0,0 +1,290 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// larkInvalidTokenCode is returned by the Lark API when a tenant access token is invalid or expired
+const larkInvalidTokenCode = 99991663
+
+// larkTokenRefreshAhead is how long before expiry a token that is in use is refreshed in the background
+const larkTokenRefreshAhead = 5 * time.Minute
+
+// larkLegacyTokenTTL bounds how long a cached token without a recorded expiry is trusted in memory
+const larkLegacyTokenTTL = time.Minute
+
+// larkAPIError is a non-zero "code" returned in a Lark API response envelope
+type larkAPIError struct {
+	Code int
+	Msg  string
+}
+
+func (e *larkAPIError) Error() string {
+	return fmt.Sprintf("lark API error %d: %s", e.Code, e.Msg)
+}
+
+// isLarkErrorCode reports whether err is a Lark API error with one of the given codes
+func isLarkErrorCode(err error, codes ...int) bool {
+	var apiErr *larkAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// larkToken is a tenant access token held in memory by a LarkProvider
+type larkToken struct {
+	value     string
+	expiresAt time.Time
+	used      bool        // set when the token is served, cleared when it is refreshed
+	timer     *time.Timer // proactive refresh ahead of expiry
+}
+
+// larkCachedToken is the shared cache representation of a tenant access token
+type larkCachedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// larkTokenCacheKey derives the token key from a hash of the credentials so that the app secret
+// never appears in key names
+func larkTokenCacheKey(cfg types.Config, appID, appSecret string) string {
+	return cacheKey(cfg, "lark_token", hashCredentials(appID, appSecret))
+}
+
+// larkLegacyTokenCacheKey is the token key used by earlier versions, read only for migration
+func larkLegacyTokenCacheKey(appID, appSecret string) string {
+	return "commonlog_lark_token:" + appID + ":" + appSecret
+}
+
+func hasLarkAppCredentials(cfg types.Config) bool {
+	return cfg.LarkToken.AppID != "" && cfg.LarkToken.AppSecret != ""
+}
+
+// resolveLarkToken returns the tenant access token for LarkToken credentials, or cfg.Token as-is.
+// force bypasses the in-memory and shared caches.
+func (p *LarkProvider) resolveLarkToken(ctx context.Context, cfg types.Config, force bool) (string, error) {
+	if !hasLarkAppCredentials(cfg) {
+		return cfg.Token, nil
+	}
+	types.DebugLog(cfg, "resolveLarkToken: resolving tenant access token for appID (length: %d), force: %t", len(cfg.LarkToken.AppID), force)
+	token, err := p.tenantAccessToken(ctx, cfg, force)
+	if err != nil {
+		types.DebugLog(cfg, "resolveLarkToken: error fetching tenant access token: %v", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// withLarkToken calls fn with a tenant access token, fetched within ctx if needed. If Lark rejects
+// the token as invalid, the token is refreshed and fn is retried once.
+func (p *LarkProvider) withLarkToken(ctx context.Context, cfg types.Config, fn func(token string) error) error {
+	token, err := p.resolveLarkToken(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	err = fn(token)
+	if !hasLarkAppCredentials(cfg) || !isLarkErrorCode(err, larkInvalidTokenCode) {
+		return err
+	}
+	types.DebugLog(cfg, "withLarkToken: tenant access token rejected, forcing refresh and retrying")
+	token, err = p.resolveLarkToken(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+// tenantAccessToken returns a tenant access token from memory, the shared cache, or the token API,
+// in that order. Concurrent misses for the same app share a single fetch.
+func (p *LarkProvider) tenantAccessToken(ctx context.Context, cfg types.Config, force bool) (string, error) {
+	appID, appSecret := cfg.LarkToken.AppID, cfg.LarkToken.AppSecret
+	key := larkTokenCacheKey(cfg, appID, appSecret)
+	if !force {
+		if token, ok := p.memoryToken(key); ok {
+			return token, nil
+		}
+	}
+
+	flightKey := "token:" + key
+	if force {
+		flightKey = "refresh:" + key
+	}
+	return p.flight.Do(ctx, flightKey, func() (string, error) {
+		if !force {
+			// Another goroutine may have refreshed the token while this one waited
+			if token, ok := p.memoryToken(key); ok {
+				return token, nil
+			}
+			if cached, ok := getCachedLarkToken(cfg, key, larkLegacyTokenCacheKey(appID, appSecret)); ok {
+				p.storeToken(cfg, key, cached.Token, cached.ExpiresAt)
+				return cached.Token, nil
+			}
+		}
+
+		token, expiresAt, err := fetchTenantAccessToken(ctx, cfg, appID, appSecret)
+		if err != nil {
+			return "", err
+		}
+		if err := cacheLarkToken(cfg, key, token, expiresAt); err != nil {
+			fmt.Printf("[Lark] Warning: failed to cache tenant access token: %v\n", err)
+		}
+		p.storeToken(cfg, key, token, expiresAt)
+		return token, nil
+	})
+}
+
+// memoryToken returns the in-memory token for key if it has not expired
+func (p *LarkProvider) memoryToken(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.tokens[key]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return "", false
+	}
+	entry.used = true
+	return entry.value, true
+}
+
+// storeToken keeps a token in memory and schedules a background refresh ahead of its expiry.
+// The refresh only happens if the token was used since it was stored, so idle credentials expire.
+func (p *LarkProvider) storeToken(cfg types.Config, key, token string, expiresAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	if p.tokens == nil {
+		p.tokens = make(map[string]*larkToken)
+		p.refreshCtx, p.cancelRefresh = context.WithCancel(context.Background())
+	}
+	if old, ok := p.tokens[key]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	entry := &larkToken{value: token, expiresAt: expiresAt}
+	p.tokens[key] = entry
+
+	refreshIn := time.Until(expiresAt) - larkTokenRefreshAhead
+	if refreshIn <= 0 {
+		return
+	}
+	entry.timer = time.AfterFunc(refreshIn, func() {
+		p.mu.Lock()
+		active := !p.closed && p.tokens[key] == entry && entry.used
+		p.mu.Unlock()
+		if !active {
+			return
+		}
+		types.DebugLog(cfg, "storeToken: refreshing tenant access token ahead of expiry")
+		if _, err := p.tenantAccessToken(p.refreshCtx, cfg, true); err != nil {
+			types.DebugLog(cfg, "storeToken: background token refresh failed: %v", err)
+		}
+	})
+}
+
+// Close stops background token refreshes, interrupting one in progress
+func (p *LarkProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.cancelRefresh != nil {
+		p.cancelRefresh()
+	}
+	for _, entry := range p.tokens {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+	return nil
+}
+
+// cacheLarkToken stores a token in the shared cache, encrypted when CacheEncryptionKey is set
+func cacheLarkToken(cfg types.Config, key, token string, expiresAt time.Time) error {
+	data, _ := json.Marshal(larkCachedToken{Token: token, ExpiresAt: expiresAt})
+	value, err := sealCacheValue(cfg, string(data))
+	if err != nil {
+		return err
+	}
+	return getCache(cfg).Set(context.Background(), key, value, time.Until(expiresAt))
+}
+
+// getCachedLarkToken reads a token from the shared cache, migrating it from legacyKey if needed.
+// A cache outage is reported as a miss so that the caller falls back to a live fetch.
+func getCachedLarkToken(cfg types.Config, key, legacyKey string) (larkCachedToken, bool) {
+	value, found, err := getCacheWithLegacy(cfg, key, legacyKey, larkLegacyTokenTTL, true)
+	if err != nil {
+		fmt.Printf("[Lark] Warning: token cache unavailable, fetching live: %v\n", err)
+		return larkCachedToken{}, false
+	}
+	if !found {
+		types.DebugLog(cfg, "getCachedLarkToken: no cached token found")
+		return larkCachedToken{}, false
+	}
+	result, err := openCacheValue(cfg, value)
+	if err != nil {
+		fmt.Printf("[Lark] Warning: ignoring unreadable cached token: %v\n", err)
+		return larkCachedToken{}, false
+	}
+	var cached larkCachedToken
+	if err := json.Unmarshal([]byte(result), &cached); err != nil || cached.Token == "" {
+		// Tokens cached by earlier versions are stored as the bare token without an expiry
+		cached = larkCachedToken{Token: result, ExpiresAt: time.Now().Add(larkLegacyTokenTTL)}
+	}
+	types.DebugLog(cfg, "getCachedLarkToken: retrieved cached token")
+	return cached, true
+}
+
+// fetchTenantAccessToken requests a new tenant access token and returns it with the time it should be
+// considered expired, 10 minutes before Lark's own expiry
+func fetchTenantAccessToken(ctx context.Context, cfg types.Config, appID, appSecret string) (string, time.Time, error) {
+	url := cfg.LarkToken.APIBaseURL() + "/auth/v3/tenant_access_token/internal"
+	payload := map[string]string{"app_id": appID, "app_secret": appSecret}
+	data, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cfg.DoHTTP(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return "", time.Time{}, &types.HTTPStatusError{Source: "lark token", StatusCode: resp.StatusCode}
+	}
+	var result struct {
+		Code   int    `json:"code"`
+		Msg    string `json:"msg"`
+		Token  string `json:"tenant_access_token"`
+		Expire int    `json:"expire"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if resp.StatusCode != 200 {
+			return "", time.Time{}, &types.HTTPStatusError{Source: "lark token", StatusCode: resp.StatusCode}
+		}
+		return "", time.Time{}, err
+	}
+	if result.Code != 0 {
+		return "", time.Time{}, fmt.Errorf("lark token error: %s", result.Msg)
+	}
+	// Consider the token expired 10 minutes early
+	expireSeconds := result.Expire - 600
+	if expireSeconds <= 0 {
+		expireSeconds = 60 // fallback to 1 minute if API returns too low
+	}
+	return result.Token, time.Now().Add(time.Duration(expireSeconds) * time.Second), nil
+}
@@ -0,0 +1,210 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// defaultLarkChatIDTTL is how long a channel-to-chat_id mapping is cached when LarkChatIDTTL is unset
+const defaultLarkChatIDTTL = 24 * time.Hour
+
+// larkSyncPageSize is the page size used when syncing the whole chat directory
+const larkSyncPageSize = 100
+
+// larkChatGoneCodes are message send errors that indicate a cached chat_id is stale:
+// the chat_id is no longer valid or the bot is no longer a member of the chat
+var larkChatGoneCodes = []int{230001, 230002}
+
+// DuplicateChatNamesError reports chat names shared by more than one chat during a sync.
+// Duplicate names are not cached, since alerts addressed by name would be ambiguous.
+type DuplicateChatNamesError struct {
+	Chats map[string][]string // chat name to the chat_ids that share it
+}
+
+func (e *DuplicateChatNamesError) Error() string {
+	names := make([]string, 0, len(e.Chats))
+	for name := range e.Chats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("lark chats with duplicate names: %s", strings.Join(names, ", "))
+}
+
+// larkChat is an entry of the im/v1/chats list
+type larkChat struct {
+	ChatID string `json:"chat_id"`
+	Name   string `json:"name"`
+}
+
+// larkChatScope identifies the Lark domain and app, or tenant token, whose chats are cached, so that
+// Loggers for different apps sharing a cache never see each other's chat_ids
+func larkChatScope(cfg types.Config) string {
+	if hasLarkAppCredentials(cfg) {
+		return hashCredentials(cfg.LarkToken.APIBaseURL(), cfg.LarkToken.AppID, cfg.LarkToken.AppSecret)
+	}
+	return hashCredentials(cfg.LarkToken.APIBaseURL(), cfg.Token)
+}
+
+func larkChatIDCacheKey(cfg types.Config, channelName string) string {
+	return cacheKey(cfg, "lark_chat_id", larkChatScope(cfg), cfg.Environment, channelName)
+}
+
+// larkLegacyChatIDCacheKey is the chat_id key used before configurable key prefixes
+func larkLegacyChatIDCacheKey(cfg types.Config, channelName string) string {
+	return "commonlog_lark_chat_id:" + cfg.Environment + ":" + channelName
+}
+
+func larkChatIDTTL(cfg types.Config) time.Duration {
+	if cfg.LarkChatIDTTL > 0 {
+		return cfg.LarkChatIDTTL
+	}
+	return defaultLarkChatIDTTL
+}
+
+func cacheChatID(cfg types.Config, channelName, chatID string) error {
+	return getCache(cfg).Set(context.Background(), larkChatIDCacheKey(cfg, channelName), chatID, larkChatIDTTL(cfg))
+}
+
+// invalidateChatID removes a cached chat_id so that the next send looks it up again
+func invalidateChatID(cfg types.Config, channelName string) {
+	if err := getCache(cfg).Delete(context.Background(), larkChatIDCacheKey(cfg, channelName)); err != nil {
+		fmt.Printf("[Lark] Warning: failed to invalidate cached chat_id for channel %s: %v\n", channelName, err)
+	}
+}
+
+func getCachedChatID(cfg types.Config, channelName string) (string, error) {
+	key := larkChatIDCacheKey(cfg, channelName)
+	result, found, err := getCacheWithLegacy(cfg, key, larkLegacyChatIDCacheKey(cfg, channelName), larkChatIDTTL(cfg), false)
+	if err != nil {
+		types.DebugLog(cfg, "getCachedChatID: error retrieving cached chat_id for channel %s: %v", channelName, err)
+		return "", err
+	}
+	if !found {
+		types.DebugLog(cfg, "getCachedChatID: no cached chat_id found for channel: %s in environment: %s", channelName, cfg.Environment)
+		return "", nil // No cached chat_id
+	}
+	types.DebugLog(cfg, "getCachedChatID: retrieved cached chat_id for channel: %s in environment: %s", channelName, cfg.Environment)
+	return result, nil
+}
+
+// getChatIDFromChannelName fetches the chat_id for a given channel name using pagination.
+// Concurrent lookups of the same channel share a single pass over the chat list.
+func (p *LarkProvider) getChatIDFromChannelName(ctx context.Context, cfg types.Config, token, channelName string) (string, error) {
+	// Try the cache first; a cache outage falls back to a live lookup
+	cached, err := getCachedChatID(cfg, channelName)
+	if err != nil {
+		fmt.Printf("[Lark] Warning: chat_id cache unavailable, fetching live: %v\n", err)
+	}
+	if cached != "" {
+		return cached, nil
+	}
+
+	return p.flight.Do(ctx, "chat:"+larkChatScope(cfg)+":"+cfg.Environment+":"+channelName, func() (string, error) {
+		return fetchChatID(ctx, cfg, token, channelName)
+	})
+}
+
+// fetchChatID pages through the chat list until it finds channelName, caching the result
+func fetchChatID(ctx context.Context, cfg types.Config, token, channelName string) (string, error) {
+	var chatID string
+	err := listLarkChats(ctx, cfg, token, 10, func(chats []larkChat) bool {
+		// Search for the channel name in the current page
+		for _, chat := range chats {
+			if chat.Name == channelName {
+				chatID = chat.ChatID
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if chatID == "" {
+		return "", fmt.Errorf("channel '%s' not found", channelName)
+	}
+	if err := cacheChatID(cfg, channelName, chatID); err != nil {
+		fmt.Printf("[Lark] Warning: failed to cache chat_id for channel %s: %v\n", channelName, err)
+	}
+	return chatID, nil
+}
+
+// listLarkChats pages through the chats the bot belongs to, calling fn with each page
+// until fn returns false or there are no more pages
+func listLarkChats(ctx context.Context, cfg types.Config, token string, pageSize int, fn func([]larkChat) bool) error {
+	baseURL := fmt.Sprintf("%s/im/v1/chats?page_size=%d", cfg.LarkToken.APIBaseURL(), pageSize)
+	pageToken := ""
+	hasMore := true
+
+	for hasMore {
+		url := baseURL
+		if pageToken != "" {
+			url += "&page_token=" + pageToken
+		}
+
+		var data struct {
+			Items     []larkChat `json:"items"`
+			PageToken string     `json:"page_token"`
+			HasMore   bool       `json:"has_more"`
+		}
+		if err := doLarkRequestContext(ctx, cfg, "GET", url, token, nil, &data); err != nil {
+			return err
+		}
+		if !fn(data.Items) {
+			return nil
+		}
+
+		// Update pagination info
+		pageToken = data.PageToken
+		hasMore = data.HasMore
+	}
+	return nil
+}
+
+// SyncChats pages through the whole chat directory once and caches the chat_id of every chat
+// by name. Names shared by several chats are left uncached and reported in a *DuplicateChatNamesError;
+// all other chats are still cached. It returns the number of chats cached.
+func (p *LarkProvider) SyncChats(ctx context.Context, cfg types.Config) (int, error) {
+	if cfg.SendMethod != types.MethodWebClient {
+		return 0, fmt.Errorf("lark chat sync requires the webclient send method")
+	}
+
+	byName := make(map[string][]string)
+	err := p.withLarkToken(ctx, cfg, func(token string) error {
+		byName = make(map[string][]string)
+		return listLarkChats(ctx, cfg, token, larkSyncPageSize, func(chats []larkChat) bool {
+			for _, chat := range chats {
+				byName[chat.Name] = append(byName[chat.Name], chat.ChatID)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cached := 0
+	duplicates := make(map[string][]string)
+	for name, chatIDs := range byName {
+		if len(chatIDs) > 1 {
+			duplicates[name] = chatIDs
+			invalidateChatID(cfg, name)
+			continue
+		}
+		if err := cacheChatID(cfg, name, chatIDs[0]); err != nil {
+			return cached, fmt.Errorf("failed to cache chat_id for channel %s: %w", name, err)
+		}
+		cached++
+	}
+	types.DebugLog(cfg, "SyncChats: cached %d chats, %d duplicate names", cached, len(duplicates))
+
+	if len(duplicates) > 0 {
+		return cached, &DuplicateChatNamesError{Chats: duplicates}
+	}
+	return cached, nil
+}
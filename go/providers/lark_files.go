@@ -0,0 +1,83 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// larkFileType maps a MIME type to the file_type accepted by the Lark file upload API
+func larkFileType(contentType string) string {
+	switch contentType {
+	case "application/pdf":
+		return "pdf"
+	case "application/msword", "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		return "doc"
+	case "application/vnd.ms-excel", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+		return "xls"
+	case "application/vnd.ms-powerpoint", "application/vnd.openxmlformats-officedocument.presentationml.presentation":
+		return "ppt"
+	default:
+		return "stream"
+	}
+}
+
+// uploadLarkFiles uploads the file attachments of alert and posts each one as a file message in the
+// thread of the delivered message
+func (p *LarkProvider) uploadLarkFiles(ctx context.Context, cfg types.Config, alert *types.Alert, messageID string) error {
+	for i, attachment := range alert.Attachments {
+		if !attachment.IsFile() {
+			continue
+		}
+		name := attachmentFileName(attachment, i)
+		types.DebugLog(cfg, "uploadLarkFiles: uploading '%s' (%d bytes)", name, len(attachment.Data))
+
+		err := p.withLarkToken(ctx, cfg, func(token string) error {
+			fileKey, err := uploadLarkFile(ctx, cfg, token, name, attachment)
+			if err != nil {
+				return err
+			}
+			content, _ := json.Marshal(map[string]string{"file_key": fileKey})
+			payload := map[string]interface{}{
+				"msg_type":        "file",
+				"content":         string(content),
+				"reply_in_thread": true,
+			}
+			url := cfg.LarkToken.APIBaseURL() + "/im/v1/messages/" + messageID + "/reply"
+			return doLarkRequestContext(ctx, cfg, "POST", url, token, payload, nil)
+		})
+		if err != nil {
+			types.DebugLog(cfg, "uploadLarkFiles: failed to upload '%s': %v", name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadLarkFile uploads a file with the im/v1/files API and returns its file_key
+func uploadLarkFile(ctx context.Context, cfg types.Config, token, name string, attachment types.Attachment) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("file_type", larkFileType(attachment.MIMEType()))
+	form.WriteField("file_name", name)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return "", err
+	}
+	part.Write(attachment.Data)
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	var data struct {
+		FileKey string `json:"file_key"`
+	}
+	url := cfg.LarkToken.APIBaseURL() + "/im/v1/files"
+	if err := doLarkRawRequest(ctx, cfg, "POST", url, token, form.FormDataContentType(), &body, &data); err != nil {
+		return "", err
+	}
+	return data.FileKey, nil
+}
@@ -2,9 +2,14 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/alvianhanif/commonlog/go/types"
 )
@@ -12,66 +17,314 @@ import (
 // SlackProvider implements Provider for Slack
 type SlackProvider struct{}
 
-func (p *SlackProvider) Send(level int, message string, attachment *types.Attachment, cfg types.Config) error {
-	return p.SendToChannel(level, message, attachment, cfg, cfg.Channel)
-}
-
-func (p *SlackProvider) SendToChannel(level int, message string, attachment *types.Attachment, cfg types.Config, channel string) error {
-	types.DebugLog(cfg, "SlackProvider.SendToChannel called with level: %d, send method: %s, channel: %s",
-		level, cfg.SendMethod, channel)
+// Deliver sends an alert, replies in the thread of alert.ThreadRef, or edits target.Replace in place.
+// Webhook deliveries return no message reference because Slack incoming webhooks do not report the
+// message ts.
+func (p *SlackProvider) Deliver(ctx context.Context, alert *types.Alert, target types.Target) (*types.DeliveryResult, error) {
+	cfg := target.Config
+	cfg.Channel = target.Channel
+	types.DebugLog(cfg, "SlackProvider.Deliver called with level: %s, send method: %s, channel: %s",
+		alert.Level, cfg.SendMethod, cfg.Channel)
+	alert, err := loadAlert(alert)
+	if err != nil {
+		return nil, err
+	}
 
-	cfgCopy := cfg
-	cfgCopy.Channel = channel
-	switch cfgCopy.SendMethod {
+	if target.Replace != nil {
+		return p.updateSlackMessage(ctx, alert, target.Replace, cfg)
+	}
+	alert = p.fitSlackAlert(alert, cfg)
+	if alert.ThreadRef != nil {
+		return p.replySlackThread(ctx, alert, alert.ThreadRef, cfg)
+	}
+	switch cfg.SendMethod {
 	case types.MethodWebClient:
 		types.DebugLog(cfg, "Using Slack webclient method")
-		return p.sendSlackWebClient(message, attachment, cfgCopy)
+		return p.sendSlackWebClient(ctx, alert, cfg)
 	case types.MethodWebhook:
 		types.DebugLog(cfg, "Using Slack webhook method")
-		return p.sendSlackWebhook(message, attachment, cfgCopy)
+		if err := p.sendSlackWebhook(ctx, alert, cfg); err != nil {
+			return nil, err
+		}
+		return &types.DeliveryResult{Provider: "slack", Channel: cfg.Channel}, nil
 	default:
-		err := fmt.Errorf("unknown send method for Slack: %s", cfgCopy.SendMethod)
+		err := fmt.Errorf("unknown send method for Slack: %s", cfg.SendMethod)
 		types.DebugLog(cfg, "Error: %v", err)
-		return err
+		return nil, err
+	}
+}
+
+func (p *SlackProvider) Send(level types.Level, message string, attachment *types.Attachment, cfg types.Config) error {
+	return p.SendToChannel(level, message, attachment, cfg, cfg.Channel)
+}
+
+func (p *SlackProvider) SendToChannel(level types.Level, message string, attachment *types.Attachment, cfg types.Config, channel string) error {
+	_, err := p.SendWithRef(level, message, attachment, cfg, channel)
+	return err
+}
+
+// SendWithRef sends a message and returns a reference to it. Webhook sends return a nil reference.
+func (p *SlackProvider) SendWithRef(level types.Level, message string, attachment *types.Attachment, cfg types.Config, channel string) (*types.MessageRef, error) {
+	result, err := p.Deliver(context.Background(), types.NewAlert(level, message, attachment, cfg), types.Target{Channel: channel, Config: cfg})
+	if result == nil {
+		return nil, err
 	}
+	return result.Ref, err
 }
 
-// formatMessage formats the alert message with optional attachment
-func (p *SlackProvider) formatMessage(message string, attachment *types.Attachment, cfg types.Config) string {
-	formatted := ""
+// Reply posts a message in the thread of a previously delivered message
+func (p *SlackProvider) Reply(ref *types.MessageRef, level types.Level, message string, attachment *types.Attachment, cfg types.Config) (*types.MessageRef, error) {
+	if ref == nil {
+		return nil, checkSlackRef(ref, cfg)
+	}
+	alert := types.NewAlert(level, message, attachment, cfg)
+	alert.ThreadRef = ref
+	result, err := p.Deliver(context.Background(), alert, types.Target{Channel: ref.Channel, Config: cfg})
+	if result == nil {
+		return nil, err
+	}
+	return result.Ref, err
+}
 
-	// Add service and environment header
-	if cfg.ServiceName != "" && cfg.Environment != "" {
-		formatted += fmt.Sprintf("*[%s - %s]*\n", cfg.ServiceName, cfg.Environment)
-	} else if cfg.ServiceName != "" {
-		formatted += fmt.Sprintf("*[%s]*\n", cfg.ServiceName)
-	} else if cfg.Environment != "" {
-		formatted += fmt.Sprintf("*[%s]*\n", cfg.Environment)
+// Update replaces the content of a previously delivered message
+func (p *SlackProvider) Update(ref *types.MessageRef, level types.Level, message string, attachment *types.Attachment, cfg types.Config) error {
+	if ref == nil {
+		return checkSlackRef(ref, cfg)
 	}
+	_, err := p.Deliver(context.Background(), types.NewAlert(level, message, attachment, cfg), types.Target{Channel: ref.Channel, Config: cfg, Replace: ref})
+	return err
+}
 
-	formatted += message
+// replySlackThread posts the alert in the thread of a previously delivered message
+func (p *SlackProvider) replySlackThread(ctx context.Context, alert *types.Alert, ref *types.MessageRef, cfg types.Config) (*types.DeliveryResult, error) {
+	types.DebugLog(cfg, "replySlackThread called with level: %s, send method: %s", alert.Level, cfg.SendMethod)
+	if err := checkSlackRef(ref, cfg); err != nil {
+		return nil, err
+	}
+	payload := p.buildPayload(alert, cfg)
+	payload["channel"] = ref.Channel
+	payload["thread_ts"] = ref.MessageID
+	result, err := doSlackRequest(ctx, cfg, "chat.postMessage", payload)
+	if err != nil {
+		types.DebugLog(cfg, "replySlackThread: error response: %v", err)
+		return nil, err
+	}
+	types.DebugLog(cfg, "replySlackThread: reply sent successfully")
+	if err := uploadSlackFiles(ctx, cfg, alert, result.Channel, ref.MessageID); err != nil {
+		return slackDeliveryResult(result), attachmentError("slack", err)
+	}
+	return slackDeliveryResult(result), nil
+}
 
-	if attachment != nil {
+// updateSlackMessage replaces the content of a previously delivered message
+func (p *SlackProvider) updateSlackMessage(ctx context.Context, alert *types.Alert, ref *types.MessageRef, cfg types.Config) (*types.DeliveryResult, error) {
+	types.DebugLog(cfg, "updateSlackMessage called with level: %s, send method: %s", alert.Level, cfg.SendMethod)
+	if err := checkSlackRef(ref, cfg); err != nil {
+		return nil, err
+	}
+	if hasFiles(alert) {
+		types.DebugLog(cfg, "updateSlackMessage: file attachments are not uploaded when updating a message")
+	}
+	payload := p.buildPayload(alert, cfg)
+	payload["channel"] = ref.Channel
+	payload["ts"] = ref.MessageID
+	result, err := doSlackRequest(ctx, cfg, "chat.update", payload)
+	if err != nil {
+		types.DebugLog(cfg, "updateSlackMessage: error response: %v", err)
+		return nil, err
+	}
+	types.DebugLog(cfg, "updateSlackMessage: message updated successfully")
+	return slackDeliveryResult(result), nil
+}
+
+// slackDeliveryResult converts a Web API response into a delivery result referencing the message
+func slackDeliveryResult(result *slackResponse) *types.DeliveryResult {
+	return &types.DeliveryResult{
+		Provider: "slack",
+		Channel:  result.Channel,
+		Ref:      &types.MessageRef{Provider: "slack", Channel: result.Channel, MessageID: result.TS},
+	}
+}
+
+// checkSlackRef validates that a message reference can be used with the Slack webclient method
+func checkSlackRef(ref *types.MessageRef, cfg types.Config) error {
+	if cfg.SendMethod != types.MethodWebClient {
+		return fmt.Errorf("slack replies and updates require the webclient send method")
+	}
+	if ref == nil || ref.Channel == "" || ref.MessageID == "" {
+		return fmt.Errorf("slack message reference is missing a channel or ts")
+	}
+	return nil
+}
+
+// formatMessage formats the alert with its inline attachments and trace and returns the header line
+// (level and title) and the body separately
+func (p *SlackProvider) formatMessage(alert *types.Alert, cfg types.Config) (string, string) {
+	// Add level and title header
+	header := fmt.Sprintf("%s *%s*", alert.Level.Emoji(), alert.Level)
+	if title := alert.TitleOrDefault(cfg); title != "" {
+		header += fmt.Sprintf(" *[%s]*", title)
+	}
+
+	formatted := alert.Message
+
+	for i, attachment := range alert.AllAttachments() {
 		if attachment.Content != "" {
 			// Inline content - show as expandable code block
-			filename := attachment.FileName
-			if filename == "" {
-				filename = "Trace Logs"
-			}
-			formatted += fmt.Sprintf("\n\n*%s:*\n```\n%s\n```", filename, attachment.Content)
+			formatted += fmt.Sprintf("\n\n*%s:*\n```\n%s\n```", attachmentFileName(attachment, i), attachment.Content)
 		}
 		if attachment.URL != "" {
 			// External URL attachment
 			formatted += fmt.Sprintf("\n\n*Attachment:* %s", attachment.URL)
 		}
+		if attachment.IsFile() && cfg.SendMethod != types.MethodWebClient {
+			// Webhooks cannot upload files, so only name them
+			formatted += fmt.Sprintf("\n\n*Attachment:* %s (%s, %d bytes, not uploaded by webhooks)",
+				attachmentFileName(attachment, i), attachment.MIMEType(), attachment.Size)
+		}
+	}
+
+	return header, formatted
+}
+
+// slackSectionTextLimit and slackSectionFieldLimit are Block Kit limits for section blocks, and
+// slackMaxBlocks the limit for a message. slackMaxBodyBlocks bounds the sections of the body.
+const (
+	slackSectionTextLimit  = 3000
+	slackSectionFieldLimit = 10
+	slackMaxBlocks         = 50
+	slackMaxBodyBlocks     = 20
+)
+
+// buildPayload builds the message payload: the header as text, and the body and structured fields as
+// Block Kit blocks in an attachment whose color bar marks the level
+func (p *SlackProvider) buildPayload(alert *types.Alert, cfg types.Config) map[string]interface{} {
+	header, body := p.formatMessage(alert, cfg)
+	return map[string]interface{}{
+		"text": header,
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"color":    alert.Level.Color(),
+				"fallback": header + "\n" + body,
+				"blocks":   slackBlocks(body, alert.Fields),
+			},
+		},
+	}
+}
+
+// slackBlocks renders the body as mrkdwn sections, split to fit the section text limit, followed by
+// the fields as section fields. The body is cut at slackMaxBodyBlocks sections, and the fields at
+// the message's block limit.
+func slackBlocks(body string, fields map[string]interface{}) []interface{} {
+	chunks := splitSlackText(body, slackSectionTextLimit)
+	if len(chunks) > slackMaxBodyBlocks {
+		omitted := 0
+		for _, chunk := range chunks[slackMaxBodyBlocks-1:] {
+			omitted += len(chunk)
+		}
+		chunks = append(chunks[:slackMaxBodyBlocks-1], fmt.Sprintf("_… truncated, %d more bytes_", omitted))
+	}
+	var blocks []interface{}
+	for _, chunk := range chunks {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": chunk},
+		})
+	}
+
+	var sectionFields []interface{}
+	for _, key := range types.SortedFieldKeys(fields) {
+		if len(blocks) == slackMaxBlocks {
+			break
+		}
+		sectionFields = append(sectionFields, map[string]interface{}{
+			"type": "mrkdwn",
+			"text": fmt.Sprintf("*%s*\n%v", key, fields[key]),
+		})
+		if len(sectionFields) == slackSectionFieldLimit {
+			blocks = append(blocks, map[string]interface{}{"type": "section", "fields": sectionFields})
+			sectionFields = nil
+		}
+	}
+	if len(sectionFields) > 0 && len(blocks) < slackMaxBlocks {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": sectionFields})
+	}
+	return blocks
+}
+
+// splitSlackText splits text into chunks of at most limit bytes, preferring line boundaries and
+// never splitting a UTF-8 character. A code block cut by a split is closed at the end of its chunk
+// and reopened at the start of the next one.
+func splitSlackText(text string, limit int) []string {
+	const fence = "```"
+	budget := limit - 2*len(fence+"\n")
+	var chunks []string
+	open := false
+	for len(text) > 0 {
+		chunk := text
+		if len(chunk) > budget {
+			chunk = chunk[:budget]
+			if i := strings.LastIndexByte(chunk, '\n'); i >= budget/2 {
+				chunk = chunk[:i+1]
+			} else {
+				for len(chunk) > 1 && !utf8.RuneStart(text[len(chunk)]) {
+					chunk = chunk[:len(chunk)-1]
+				}
+			}
+		}
+		text = text[len(chunk):]
+
+		out := chunk
+		if open {
+			out = fence + "\n" + out
+		}
+		if strings.Count(chunk, fence)%2 == 1 {
+			open = !open
+		}
+		if open && len(text) > 0 {
+			out = strings.TrimSuffix(out, "\n") + "\n" + fence
+		}
+		chunks = append(chunks, out)
 	}
+	return chunks
+}
 
-	return formatted
+// fitSlackAlert moves inline attachment content and the trace into file uploads when the body
+// would not fit in slackMaxBodyBlocks sections, along with the full message if that alone does not
+// fit. Only the webclient method uploads files; webhook bodies are truncated instead.
+func (p *SlackProvider) fitSlackAlert(alert *types.Alert, cfg types.Config) *types.Alert {
+	if cfg.SendMethod != types.MethodWebClient {
+		return alert
+	}
+	if _, body := p.formatMessage(alert, cfg); len(splitSlackText(body, slackSectionTextLimit)) <= slackMaxBodyBlocks {
+		return alert
+	}
+	fitted := *alert
+	fitted.Trace = ""
+	fitted.Attachments = nil
+	for i, attachment := range alert.AllAttachments() {
+		if attachment.Content != "" && !attachment.IsFile() {
+			attachment.FileName = attachmentFileName(attachment, i)
+			attachment.Data = []byte(attachment.Content)
+			attachment.Size = int64(len(attachment.Data))
+			attachment.Content = ""
+		}
+		fitted.Attachments = append(fitted.Attachments, attachment)
+	}
+	if len(splitSlackText(fitted.Message, slackSectionTextLimit)) > slackMaxBodyBlocks {
+		fitted.Attachments = append(fitted.Attachments, types.Attachment{
+			FileName:    "message.txt",
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte(alert.Message),
+			Size:        int64(len(alert.Message)),
+		})
+	}
+	types.DebugLog(cfg, "fitSlackAlert: body too long for Block Kit, uploading %d attachments as files", len(fitted.Attachments))
+	return &fitted
 }
 
-func (p *SlackProvider) sendSlackWebhook(message string, attachment *types.Attachment, cfg types.Config) error {
+func (p *SlackProvider) sendSlackWebhook(ctx context.Context, alert *types.Alert, cfg types.Config) error {
 	types.DebugLog(cfg, "sendSlackWebhook: formatting message and preparing webhook request")
-	formattedMessage := p.formatMessage(message, attachment, cfg)
 
 	// For webhook, the token field contains the webhook URL
 	webhookURL := cfg.Token
@@ -82,9 +335,7 @@ func (p *SlackProvider) sendSlackWebhook(message string, attachment *types.Attac
 	}
 	types.DebugLog(cfg, "sendSlackWebhook: using webhook URL (length: %d), channel: %s", len(webhookURL), cfg.Channel)
 
-	payload := map[string]interface{}{
-		"text": formattedMessage,
-	}
+	payload := p.buildPayload(alert, cfg)
 	// If channel is specified, include it in the payload
 	if cfg.Channel != "" {
 		payload["channel"] = cfg.Channel
@@ -93,11 +344,14 @@ func (p *SlackProvider) sendSlackWebhook(message string, attachment *types.Attac
 	data, _ := json.Marshal(payload)
 	types.DebugLog(cfg, "sendSlackWebhook: payload prepared, size: %d bytes", len(data))
 
-	req, _ := http.NewRequest("POST", webhookURL, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	types.DebugLog(cfg, "sendSlackWebhook: sending HTTP request to webhook URL")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.DoHTTP(req)
 	if err != nil {
 		types.DebugLog(cfg, "sendSlackWebhook: HTTP request failed: %v", err)
 		return err
@@ -110,7 +364,7 @@ func (p *SlackProvider) sendSlackWebhook(message string, attachment *types.Attac
 	types.DebugLog(cfg, "sendSlackWebhook: response status: %d, body length: %d, body: %s", resp.StatusCode, respData.Len(), respData.String())
 
 	if resp.StatusCode != 200 {
-		err := fmt.Errorf("slack webhook response: %d", resp.StatusCode)
+		err := &types.HTTPStatusError{Source: "slack webhook", StatusCode: resp.StatusCode}
 		types.DebugLog(cfg, "sendSlackWebhook: error response: %v", err)
 		return err
 	}
@@ -118,51 +372,87 @@ func (p *SlackProvider) sendSlackWebhook(message string, attachment *types.Attac
 	return nil
 }
 
-func (p *SlackProvider) sendSlackWebClient(message string, attachment *types.Attachment, cfg types.Config) error {
+func (p *SlackProvider) sendSlackWebClient(ctx context.Context, alert *types.Alert, cfg types.Config) (*types.DeliveryResult, error) {
 	types.DebugLog(cfg, "sendSlackWebClient: formatting message and preparing API request")
-	formattedMessage := p.formatMessage(message, attachment, cfg)
+	payload := p.buildPayload(alert, cfg)
+	payload["channel"] = cfg.Channel
+	types.DebugLog(cfg, "sendSlackWebClient: sending to channel: %s", cfg.Channel)
 
-	// Use SlackToken if available, otherwise fall back to Token
-	token := cfg.Token
-	if cfg.SlackToken != "" {
-		token = cfg.SlackToken
-		types.DebugLog(cfg, "sendSlackWebClient: using SlackToken (length: %d)", len(token))
-	} else {
-		types.DebugLog(cfg, "sendSlackWebClient: using Token (length: %d)", len(token))
+	result, err := doSlackRequest(ctx, cfg, "chat.postMessage", payload)
+	if err != nil {
+		types.DebugLog(cfg, "sendSlackWebClient: error response: %v", err)
+		return nil, err
 	}
+	types.DebugLog(cfg, "sendSlackWebClient: message sent successfully")
+	if err := uploadSlackFiles(ctx, cfg, alert, result.Channel, result.TS); err != nil {
+		return slackDeliveryResult(result), attachmentError("slack", err)
+	}
+	return slackDeliveryResult(result), nil
+}
 
-	url := "https://slack.com/api/chat.postMessage"
-	headers := map[string]string{"Authorization": "Bearer " + token, "Content-Type": "application/json; charset=utf-8"}
-	payload := map[string]interface{}{
-		"channel": cfg.Channel,
-		"text":    formattedMessage,
+// slackToken returns SlackToken if set, otherwise Token
+func slackToken(cfg types.Config) string {
+	if cfg.SlackToken != "" {
+		types.DebugLog(cfg, "slackToken: using SlackToken (length: %d)", len(cfg.SlackToken))
+		return cfg.SlackToken
 	}
+	types.DebugLog(cfg, "slackToken: using Token (length: %d)", len(cfg.Token))
+	return cfg.Token
+}
+
+// slackResponse is the common envelope returned by Slack Web API methods
+type slackResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	Channel   string `json:"channel"`
+	TS        string `json:"ts"`
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+// doSlackRequest calls a Slack Web API method with a JSON payload and checks the "ok" flag
+func doSlackRequest(ctx context.Context, cfg types.Config, apiMethod string, payload interface{}) (*slackResponse, error) {
 	data, _ := json.Marshal(payload)
-	types.DebugLog(cfg, "sendSlackWebClient: sending to channel: %s, payload size: %d bytes", cfg.Channel, len(data))
+	types.DebugLog(cfg, "doSlackRequest: calling %s, payload size: %d bytes", apiMethod, len(data))
+	return callSlackAPI(ctx, cfg, apiMethod, "application/json; charset=utf-8", bytes.NewBuffer(data))
+}
+
+// doSlackFormRequest calls a Slack Web API method that only accepts form-encoded arguments
+func doSlackFormRequest(ctx context.Context, cfg types.Config, apiMethod string, form url.Values) (*slackResponse, error) {
+	types.DebugLog(cfg, "doSlackFormRequest: calling %s", apiMethod)
+	return callSlackAPI(ctx, cfg, apiMethod, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
 
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	for k, v := range headers {
-		req.Header.Set(k, v)
+// callSlackAPI sends an authenticated request to a Slack Web API method and checks the "ok" flag
+func callSlackAPI(ctx context.Context, cfg types.Config, apiMethod, contentType string, body io.Reader) (*slackResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://slack.com/api/"+apiMethod, body)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+slackToken(cfg))
+	req.Header.Set("Content-Type", contentType)
 
-	types.DebugLog(cfg, "sendSlackWebClient: sending HTTP request to Slack API")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.DoHTTP(req)
 	if err != nil {
-		types.DebugLog(cfg, "sendSlackWebClient: HTTP request failed: %v", err)
-		return err
+		types.DebugLog(cfg, "doSlackRequest: HTTP request failed: %v", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// Log response data
 	respData := new(bytes.Buffer)
 	respData.ReadFrom(resp.Body)
-	types.DebugLog(cfg, "sendSlackWebClient: response status: %d, body length: %d, body: %s", resp.StatusCode, respData.Len(), respData.String())
+	types.DebugLog(cfg, "doSlackRequest: response status: %d, body length: %d, body: %s", resp.StatusCode, respData.Len(), respData.String())
 
 	if resp.StatusCode != 200 {
-		err := fmt.Errorf("slack WebClient response: %d", resp.StatusCode)
-		types.DebugLog(cfg, "sendSlackWebClient: error response: %v", err)
-		return err
+		return nil, &types.HTTPStatusError{Source: "slack WebClient", StatusCode: resp.StatusCode}
 	}
-	types.DebugLog(cfg, "sendSlackWebClient: message sent successfully")
-	return nil
+	var result slackResponse
+	if err := json.Unmarshal(respData.Bytes(), &result); err != nil {
+		return nil, err
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("slack %s error: %s", apiMethod, result.Error)
+	}
+	return &result, nil
 }
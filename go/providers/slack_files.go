@@ -0,0 +1,67 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// uploadSlackFiles uploads the file attachments of alert and shares them in the thread of the
+// delivered message, using the external upload flow of the files API
+func uploadSlackFiles(ctx context.Context, cfg types.Config, alert *types.Alert, channelID, threadTS string) error {
+	var files []interface{}
+	for i, attachment := range alert.Attachments {
+		if !attachment.IsFile() {
+			continue
+		}
+		name := attachmentFileName(attachment, i)
+		types.DebugLog(cfg, "uploadSlackFiles: uploading '%s' (%d bytes)", name, len(attachment.Data))
+		fileID, err := uploadSlackFile(ctx, cfg, name, attachment)
+		if err != nil {
+			types.DebugLog(cfg, "uploadSlackFiles: failed to upload '%s': %v", name, err)
+			return err
+		}
+		files = append(files, map[string]interface{}{"id": fileID, "title": name})
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"files":      files,
+		"channel_id": channelID,
+		"thread_ts":  threadTS,
+	}
+	_, err := doSlackRequest(ctx, cfg, "files.completeUploadExternal", payload)
+	return err
+}
+
+// uploadSlackFile reserves an upload URL, sends the file content to it and returns the file ID
+func uploadSlackFile(ctx context.Context, cfg types.Config, name string, attachment types.Attachment) (string, error) {
+	form := url.Values{}
+	form.Set("filename", name)
+	form.Set("length", strconv.Itoa(len(attachment.Data)))
+	result, err := doSlackFormRequest(ctx, cfg, "files.getUploadURLExternal", form)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", result.UploadURL, bytes.NewReader(attachment.Data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", attachment.MIMEType())
+	resp, err := cfg.DoHTTP(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", &types.HTTPStatusError{Source: "slack file upload", StatusCode: resp.StatusCode}
+	}
+	return result.FileID, nil
+}
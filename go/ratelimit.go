@@ -0,0 +1,218 @@
+package commonlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Rate Limiting
+// ====================
+
+// ErrRateLimited is recorded for alerts held back by a rate limit, and returned for dropped alerts
+var ErrRateLimited = errors.New("commonlog: alert rate limited")
+
+// maxSummaryMessages bounds the messages listed in a rate limit summary
+const maxSummaryMessages = 5
+
+// defaultRateLimitMaxWait bounds the wait of RateLimitQueue when RateLimitMaxWait is unset
+const defaultRateLimitMaxWait = 5 * time.Second
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take consumes a token if one is available and returns zero, or returns how long until one is
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateSummary collects the alerts held back for one channel until a summary is sent
+type rateSummary struct {
+	count    int
+	level    types.Level
+	messages []string
+	timer    *time.Timer
+	send     func()
+}
+
+// rateLimiter holds a token bucket and pending summary per provider and channel
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	summaries map[string]*rateSummary
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), summaries: make(map[string]*rateSummary)}
+}
+
+// take consumes a token from the bucket for key, creating a full bucket on first use
+func (r *rateLimiter) take(key string, limit types.RateLimit) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		burst := float64(limit.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		b = &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: time.Now()}
+		r.buckets[key] = b
+	}
+	return b.take(time.Now())
+}
+
+// wait blocks until the bucket for key has a token or ctx is done
+func (r *rateLimiter) wait(ctx context.Context, key string, limit types.RateLimit) error {
+	for {
+		delay := r.take(key, limit)
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// admit applies the rate limit for the alert's provider and channel according to RateLimitPolicy,
+// and reports whether the alert should be sent now. RateLimitQueue waits at most RateLimitMaxWait,
+// then collapses the alert into a summary like RateLimitSummarize, so a send never blocks unbounded.
+func (r *rateLimiter) admit(ctx context.Context, l *Logger, provider types.Provider, providerName string,
+	alert *types.Alert, channel string, limit types.RateLimit) (bool, error) {
+	key := providerName + "\x00" + channel
+	switch l.config.RateLimitPolicy {
+	case types.RateLimitDrop:
+		if r.take(key, limit) == 0 {
+			return true, nil
+		}
+		types.DebugLog(l.config, "rate limit: dropped alert to %s channel %s", providerName, channel)
+		l.logLocal(ctx, alert, providerName, channel, false, ErrRateLimited)
+		return false, ErrRateLimited
+	case types.RateLimitSummarize:
+		delay := r.take(key, limit)
+		if delay == 0 {
+			return true, nil
+		}
+		r.summarize(ctx, l, provider, providerName, alert, channel, key, delay, limit)
+		return false, nil
+	default:
+		maxWait := l.config.RateLimitMaxWait
+		if maxWait <= 0 {
+			maxWait = defaultRateLimitMaxWait
+		}
+		delay := r.take(key, limit)
+		if delay == 0 {
+			return true, nil
+		}
+		if delay <= maxWait {
+			waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+			err := r.wait(waitCtx, key, limit)
+			cancel()
+			if err == nil {
+				return true, nil
+			}
+			if ctx.Err() != nil {
+				l.logLocal(ctx, alert, providerName, channel, false, ctx.Err())
+				return false, ctx.Err()
+			}
+			delay = r.take(key, limit)
+			if delay == 0 {
+				return true, nil
+			}
+		}
+		r.summarize(ctx, l, provider, providerName, alert, channel, key, delay, limit)
+		return false, nil
+	}
+}
+
+// summarize records a limited alert locally and collapses it into the pending summary for key
+func (r *rateLimiter) summarize(ctx context.Context, l *Logger, provider types.Provider, providerName string,
+	alert *types.Alert, channel, key string, delay time.Duration, limit types.RateLimit) {
+	types.DebugLog(l.config, "rate limit: collapsing alert to %s channel %s into a summary", providerName, channel)
+	l.logLocal(ctx, alert, providerName, channel, false, ErrRateLimited)
+	// Not through dispatchAlert: collapse takes the summary's token from the channel's bucket itself,
+	// except when Close flushes it
+	r.collapse(key, delay, limit, alert, func(summary *types.Alert) {
+		l.deliverAlert(context.Background(), provider, providerName, summary, channel, nil)
+	})
+}
+
+// collapse adds an alert to the pending summary for key, scheduling the summary for when the limit
+// allows it if none is pending. deliver is called once a token has been taken for the summary, or by Close.
+func (r *rateLimiter) collapse(key string, delay time.Duration, limit types.RateLimit, alert *types.Alert, deliver func(*types.Alert)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.summaries[key]
+	if !ok {
+		s = &rateSummary{}
+		s.send = func() { deliver(summaryAlert(s)) }
+		s.timer = time.AfterFunc(delay, func() {
+			r.mu.Lock()
+			pending := r.summaries[key] == s
+			delete(r.summaries, key)
+			r.mu.Unlock()
+			if pending && r.wait(context.Background(), key, limit) == nil {
+				s.send()
+			}
+		})
+		r.summaries[key] = s
+	}
+	s.count++
+	if alert.Level > s.level {
+		s.level = alert.Level
+	}
+	if len(s.messages) < maxSummaryMessages {
+		s.messages = append(s.messages, alert.Message)
+	}
+}
+
+// summaryAlert builds the alert listing the alerts collapsed into a summary
+func summaryAlert(s *rateSummary) *types.Alert {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s rate limited:", s.count, plural(int64(s.count), "alert was", "alerts were"))
+	for _, message := range s.messages {
+		first, _, _ := strings.Cut(message, "\n")
+		b.WriteString("\n• " + first)
+	}
+	if more := s.count - len(s.messages); more > 0 {
+		fmt.Fprintf(&b, "\n(and %d more)", more)
+	}
+	return &types.Alert{Level: s.level, Message: b.String(), Timestamp: time.Now()}
+}
+
+// Close sends pending summaries immediately, without waiting for the limit
+func (r *rateLimiter) Close() error {
+	r.mu.Lock()
+	summaries := r.summaries
+	r.summaries = make(map[string]*rateSummary)
+	r.mu.Unlock()
+	for _, s := range summaries {
+		if s.timer.Stop() {
+			s.send()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package commonlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Local Sinks
+// ====================
+
+// writerSink writes one JSON object per record
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a LocalSink that writes each record to w as a line of JSON
+func NewWriterSink(w io.Writer) types.LocalSink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Log(ctx context.Context, record types.LocalRecord) error {
+	entry := map[string]interface{}{
+		"time":    record.Time.Format(time.RFC3339Nano),
+		"level":   record.Level.String(),
+		"message": record.Message,
+		"remote":  record.Remote,
+	}
+	for _, kv := range recordAttrs(record) {
+		entry[kv[0]] = kv[1]
+	}
+	if len(record.Fields) > 0 {
+		entry["fields"] = record.Fields
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// logSink writes records through a *log.Logger as "[LEVEL] message key=value ..."
+type logSink struct {
+	logger *log.Logger
+}
+
+// NewLogSink returns a LocalSink that writes each record through logger in a key=value format
+func NewLogSink(logger *log.Logger) types.LocalSink {
+	return &logSink{logger: logger}
+}
+
+func (s *logSink) Log(ctx context.Context, record types.LocalRecord) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", record.Level, record.Message)
+	if record.Remote {
+		b.WriteString(" remote=true")
+	}
+	for _, kv := range recordAttrs(record) {
+		fmt.Fprintf(&b, " %s=%q", kv[0], kv[1])
+	}
+	for _, key := range types.SortedFieldKeys(record.Fields) {
+		fmt.Fprintf(&b, " %s=%q", key, fmt.Sprint(record.Fields[key]))
+	}
+	return s.logger.Output(2, b.String())
+}
+
+// slogSink hands records to a slog.Handler
+type slogSink struct {
+	handler slog.Handler
+}
+
+// NewSlogSink returns a LocalSink that hands each record to handler
+func NewSlogSink(handler slog.Handler) types.LocalSink {
+	return &slogSink{handler: handler}
+}
+
+func (s *slogSink) Log(ctx context.Context, record types.LocalRecord) error {
+	level := slogLevel(record.Level)
+	if !s.handler.Enabled(ctx, level) {
+		return nil
+	}
+	r := slog.NewRecord(record.Time, level, record.Message, 0)
+	r.AddAttrs(slog.Bool("remote", record.Remote))
+	for _, kv := range recordAttrs(record) {
+		r.AddAttrs(slog.String(kv[0], kv[1]))
+	}
+	for _, key := range types.SortedFieldKeys(record.Fields) {
+		r.AddAttrs(slog.Any(key, record.Fields[key]))
+	}
+	return s.handler.Handle(ctx, r)
+}
+
+// slogLevel maps an alert level to the closest slog level
+func slogLevel(level types.Level) slog.Level {
+	switch level {
+	case types.DEBUG:
+		return slog.LevelDebug
+	case types.INFO:
+		return slog.LevelInfo
+	case types.NOTICE:
+		return slog.LevelInfo + 2
+	case types.WARN:
+		return slog.LevelWarn
+	case types.ERROR:
+		return slog.LevelError
+	case types.CRITICAL:
+		return slog.LevelError + 4
+	default:
+		return slog.LevelError + 8
+	}
+}
+
+// recordAttrs returns the non-empty metadata of a record as ordered key/value pairs
+func recordAttrs(record types.LocalRecord) [][2]string {
+	var attrs [][2]string
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, [2]string{key, value})
+		}
+	}
+	add("service", record.Service)
+	add("environment", record.Environment)
+	add("provider", record.Provider)
+	add("channel", record.Channel)
+	if record.Error != nil {
+		add("error", record.Error.Error())
+	}
+	return attrs
+}
+
+// logLocal writes a record to the configured sink, or the standard logger by default
+func (l *Logger) logLocal(ctx context.Context, alert *types.Alert, provider, channel string, remote bool, sendErr error) {
+	sink := l.config.LocalSink
+	if sink == nil {
+		sink = defaultSink
+	}
+	record := types.LocalRecord{
+		Time:        alert.Timestamp,
+		Level:       alert.Level,
+		Message:     alert.Message,
+		Service:     l.config.ServiceName,
+		Environment: l.config.Environment,
+		Channel:     channel,
+		Fields:      alert.Fields,
+		Remote:      remote,
+		Error:       sendErr,
+	}
+	if remote {
+		record.Provider = provider
+	}
+	if err := sink.Log(ctx, record); err != nil {
+		types.DebugLog(l.config, "Local sink failed: %v", err)
+	}
+}
+
+// defaultSink writes through the standard logger
+var defaultSink = NewLogSink(log.Default())
@@ -0,0 +1,179 @@
+package commonlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// slog Handler
+// ====================
+
+// SlogHandlerOptions configures a handler created by NewSlogHandler
+type SlogHandlerOptions struct {
+	// Next receives every record, so that normal logging continues. If nil, records are only alerted.
+	Next slog.Handler
+	// Level is the lowest record level that becomes an alert (defaults to slog.LevelError)
+	Level slog.Leveler
+	// Channel overrides the channel resolved by the Logger
+	Channel string
+}
+
+// slogHandler wraps a slog.Handler and sends records at or above a threshold as commonlog alerts
+type slogHandler struct {
+	logger *Logger
+	opts   SlogHandlerOptions
+	attrs  []slog.Attr // attributes added with WithAttrs, already qualified by their groups
+	groups []string    // groups opened with WithGroup
+}
+
+// NewSlogHandler returns a slog.Handler that passes every record to opts.Next and sends records at or
+// above opts.Level through logger. Record attributes become structured fields of the alert, with group
+// names joined by dots, and error-valued attributes become the trace. Alerts are queued with
+// DeliverAsync.
+//
+// Do not use a LocalSink that writes back to the returned handler, as mirrored alerts would be alerted again.
+func NewSlogHandler(logger *Logger, opts *SlogHandlerOptions) slog.Handler {
+	h := &slogHandler{logger: logger}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Level == nil {
+		h.opts.Level = slog.LevelError
+	}
+	return h
+}
+
+func (h *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= h.opts.Level.Level() {
+		return true
+	}
+	return h.opts.Next != nil && h.opts.Next.Enabled(ctx, level)
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var nextErr error
+	if h.opts.Next != nil && h.opts.Next.Enabled(ctx, r.Level) {
+		nextErr = h.opts.Next.Handle(ctx, r)
+	}
+	if r.Level < h.opts.Level.Level() {
+		return nextErr
+	}
+
+	var fields []interface{}
+	var traces []string
+	add := func(key string, value slog.Value) {
+		if err, ok := value.Any().(error); ok && value.Kind() == slog.KindAny {
+			traces = append(traces, fmt.Sprintf("%s: %+v", key, err))
+			return
+		}
+		fields = append(fields, key, value.Any())
+	}
+	for _, a := range h.attrs {
+		flattenSlogAttr("", a, add)
+	}
+	prefix := strings.Join(h.groups, ".")
+	r.Attrs(func(a slog.Attr) bool {
+		flattenSlogAttr(prefix, a, add)
+		return true
+	})
+
+	logger := h.logger
+	if len(fields) > 0 {
+		logger = logger.With(fields...)
+	}
+	alert := &types.Alert{
+		Level:     levelFromSlog(r.Level),
+		Message:   r.Message,
+		Trace:     strings.Join(traces, "\n\n"),
+		Timestamp: r.Time,
+	}
+	// The record's context is often done already when a timeout is logged. A dropped alert does not
+	// fail the log call.
+	if !logger.DeliverAsync(context.WithoutCancel(ctx), alert, h.opts.Channel) {
+		types.DebugLog(h.logger.config, "slog handler: alert not queued")
+	}
+	return nextErr
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := h.clone()
+	if h.opts.Next != nil {
+		clone.opts.Next = h.opts.Next.WithAttrs(attrs)
+	}
+	prefix := strings.Join(h.groups, ".")
+	for _, a := range attrs {
+		if prefix != "" {
+			a.Key = prefix + "." + a.Key
+		}
+		clone.attrs = append(clone.attrs, a)
+	}
+	return clone
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := h.clone()
+	if h.opts.Next != nil {
+		clone.opts.Next = h.opts.Next.WithGroup(name)
+	}
+	clone.groups = append(clone.groups, name)
+	return clone
+}
+
+func (h *slogHandler) clone() *slogHandler {
+	return &slogHandler{
+		logger: h.logger,
+		opts:   h.opts,
+		attrs:  append([]slog.Attr(nil), h.attrs...),
+		groups: append([]string(nil), h.groups...),
+	}
+}
+
+// flattenSlogAttr resolves an attribute and calls add for it, or for each member of a group,
+// with keys qualified by their enclosing groups
+func flattenSlogAttr(prefix string, a slog.Attr, add func(key string, value slog.Value)) {
+	value := a.Value.Resolve()
+	if a.Key == "" && value.Kind() != slog.KindGroup {
+		return
+	}
+	key := a.Key
+	if prefix != "" && key != "" {
+		key = prefix + "." + key
+	} else if key == "" {
+		key = prefix // inline group
+	}
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			flattenSlogAttr(key, member, add)
+		}
+		return
+	}
+	add(key, value)
+}
+
+// levelFromSlog maps a slog level to the closest alert level, the inverse of slogLevel
+func levelFromSlog(level slog.Level) types.Level {
+	switch {
+	case level < slog.LevelInfo:
+		return types.DEBUG
+	case level < slog.LevelInfo+2:
+		return types.INFO
+	case level < slog.LevelWarn:
+		return types.NOTICE
+	case level < slog.LevelError:
+		return types.WARN
+	case level < slog.LevelError+4:
+		return types.ERROR
+	case level < slog.LevelError+8:
+		return types.CRITICAL
+	default:
+		return types.FATAL
+	}
+}
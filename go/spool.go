@@ -0,0 +1,426 @@
+package commonlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alvianhanif/commonlog/go/types"
+)
+
+// ====================
+// Spool
+// ====================
+
+// ErrSpoolFull is reported for alerts that could not be spooled because the spool reached MaxSize
+var ErrSpoolFull = errors.New("commonlog: spool full")
+
+// Defaults for the spool when Spool.Dir is set
+const (
+	defaultSpoolSegmentSize   = 4 << 20
+	defaultSpoolMaxSize       = 64 << 20
+	defaultSpoolSyncInterval  = time.Second
+	defaultSpoolRetryInterval = 30 * time.Second
+)
+
+// spoolCursorFile records how far the oldest segment has been replayed
+const spoolCursorFile = "cursor.json"
+
+// SpoolStats describes the alerts waiting in the spool
+type SpoolStats struct {
+	Depth  int           // Spooled alerts not yet delivered
+	Bytes  int64         // Size of the spool segments on disk
+	Oldest time.Time     // When the oldest waiting alert was spooled; zero when the spool is empty
+	Age    time.Duration // How long the oldest waiting alert has waited
+}
+
+// spoolRecord is one line of a segment file
+type spoolRecord struct {
+	Provider  string       `json:"provider"`
+	Channel   string       `json:"channel"`
+	SpooledAt time.Time    `json:"spooled_at"`
+	Alert     *types.Alert `json:"alert"`
+}
+
+// spoolEntry is a record read back from a segment, with its position in the file
+type spoolEntry struct {
+	record spoolRecord
+	end    int64
+}
+
+// spoolSegment is an append-only segment file
+type spoolSegment struct {
+	name   string
+	size   int64
+	oldest time.Time // when its first pending record was spooled
+}
+
+// spoolCursor is the replay position in the oldest segment
+type spoolCursor struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// spool appends undeliverable alerts to segment files and replays them in order
+type spool struct {
+	cfg      types.SpoolConfig
+	mu       sync.Mutex
+	segments []*spoolSegment // oldest first; file, when open, is the last one
+	file     *os.File
+	next     int // sequence number of the next segment
+	cursor   spoolCursor
+	depth    int
+	bytes    int64
+	dirty    bool // appended since the last sync
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// openSpool opens the spool directory and counts the alerts left by a previous process. Appends
+// always start a new segment, so a record cut short by a crash is never written after. The directory
+// is not locked; the caller owns it exclusively.
+func openSpool(cfg types.SpoolConfig) (*spool, error) {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSpoolSegmentSize
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultSpoolMaxSize
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = defaultSpoolSyncInterval
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultSpoolRetryInterval
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.Dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	s := &spool{cfg: cfg, done: make(chan struct{})}
+	if data, err := os.ReadFile(filepath.Join(cfg.Dir, spoolCursorFile)); err == nil {
+		json.Unmarshal(data, &s.cursor)
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		var seq int
+		if _, err := fmt.Sscanf(name, "segment-%d.log", &seq); err == nil && seq >= s.next {
+			s.next = seq + 1
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.segments) == 0 && s.cursor.Segment != name {
+			s.cursor = spoolCursor{}
+		}
+		segment := &spoolSegment{name: name, size: info.Size()}
+		entries, err := s.readSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			segment.oldest = entries[0].record.SpooledAt
+		}
+		s.segments = append(s.segments, segment)
+		s.bytes += segment.size
+		s.depth += len(entries)
+	}
+	if len(s.segments) == 0 {
+		s.cursor = spoolCursor{}
+	}
+	return s, nil
+}
+
+// start runs the worker that replays spooled alerts with deliver every RetryInterval
+func (s *spool) start(deliver func(context.Context, spoolRecord) error) {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go func() {
+		defer close(s.done)
+		retry := time.NewTicker(s.cfg.RetryInterval)
+		defer retry.Stop()
+		var syncC <-chan time.Time
+		if s.cfg.Sync == types.SpoolSyncInterval {
+			ticker := time.NewTicker(s.cfg.SyncInterval)
+			defer ticker.Stop()
+			syncC = ticker.C
+		}
+
+		s.replay(deliver)
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-retry.C:
+				s.replay(deliver)
+			case <-syncC:
+				s.mu.Lock()
+				if s.dirty && s.file != nil {
+					s.file.Sync()
+					s.dirty = false
+				}
+				s.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// append writes a record to the current segment, starting a new one when it is full
+func (s *spool) append(record spoolRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("spool is closed")
+	}
+	if s.bytes+int64(len(line)) > s.cfg.MaxSize {
+		return ErrSpoolFull
+	}
+	if current := len(s.segments) - 1; s.file == nil ||
+		s.segments[current].size > 0 && s.segments[current].size+int64(len(line)) > s.cfg.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	segment := s.segments[len(s.segments)-1]
+	n, err := s.file.Write(line)
+	segment.size += int64(n)
+	s.bytes += int64(n)
+	if err != nil {
+		// Start a new segment rather than append after a partial record
+		s.seal()
+		return err
+	}
+	if segment.oldest.IsZero() {
+		segment.oldest = record.SpooledAt
+	}
+	s.depth++
+	switch s.cfg.Sync {
+	case types.SpoolSyncNever:
+	case types.SpoolSyncInterval:
+		s.dirty = true
+	default:
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// rotate seals the current segment and creates the next one. The caller holds s.mu.
+func (s *spool) rotate() error {
+	if err := s.seal(); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("segment-%020d.log", s.next)
+	file, err := os.OpenFile(filepath.Join(s.cfg.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	s.next++
+	s.file = file
+	s.segments = append(s.segments, &spoolSegment{name: name})
+	return nil
+}
+
+// seal syncs and closes the current segment, which is then only read. The caller holds s.mu.
+func (s *spool) seal() error {
+	if s.file == nil {
+		return nil
+	}
+	var err error
+	if s.cfg.Sync != types.SpoolSyncNever {
+		err = s.file.Sync()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file, s.dirty = nil, false
+	return err
+}
+
+// readSegment reads the pending records of a sealed segment. Lines that cannot be parsed, such as
+// a record cut short by a crash, are skipped.
+func (s *spool) readSegment(segment *spoolSegment) ([]spoolEntry, error) {
+	data, err := os.ReadFile(filepath.Join(s.cfg.Dir, segment.name))
+	if err != nil {
+		return nil, err
+	}
+	var offset int64
+	if s.cursor.Segment == segment.name {
+		offset = s.cursor.Offset
+	}
+	var entries []spoolEntry
+	for offset < int64(len(data)) {
+		line, end := data[offset:], int64(len(data))
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, end = line[:i], offset+int64(i)+1
+		}
+		var record spoolRecord
+		if json.Unmarshal(line, &record) == nil && record.Alert != nil {
+			entries = append(entries, spoolEntry{record: record, end: end})
+		}
+		offset = end
+	}
+	return entries, nil
+}
+
+// replay delivers spooled alerts oldest first, removing each segment once it is replayed. It
+// stops at the first alert that deliver reports as still undeliverable, to retry it on the next run.
+func (s *spool) replay(deliver func(context.Context, spoolRecord) error) {
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 || s.ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		segment := s.segments[0]
+		if len(s.segments) == 1 {
+			s.seal()
+		}
+		entries, err := s.readSegment(segment)
+		s.mu.Unlock()
+		if err != nil {
+			fmt.Printf("[commonlog] Warning: failed to read spool segment %s: %v\n", segment.name, err)
+			return
+		}
+
+		for i, entry := range entries {
+			if err := deliver(s.ctx, entry.record); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.depth--
+			segment.oldest = time.Time{}
+			if i+1 < len(entries) {
+				segment.oldest = entries[i+1].record.SpooledAt
+			}
+			s.saveCursor(spoolCursor{Segment: segment.name, Offset: entry.end})
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		if err := os.Remove(filepath.Join(s.cfg.Dir, segment.name)); err != nil {
+			fmt.Printf("[commonlog] Warning: failed to remove spool segment %s: %v\n", segment.name, err)
+		}
+		s.segments = s.segments[1:]
+		s.bytes -= segment.size
+		s.saveCursor(spoolCursor{})
+		s.mu.Unlock()
+	}
+}
+
+// saveCursor atomically replaces the cursor file. The caller holds s.mu.
+func (s *spool) saveCursor(cursor spoolCursor) {
+	s.cursor = cursor
+	path := filepath.Join(s.cfg.Dir, spoolCursorFile)
+	if cursor.Segment == "" {
+		os.Remove(path)
+		return
+	}
+	data, _ := json.Marshal(cursor)
+	err := os.WriteFile(path+".tmp", data, 0o600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Printf("[commonlog] Warning: failed to save spool cursor: %v\n", err)
+	}
+}
+
+// stats returns the depth, size and age of the spool
+func (s *spool) stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SpoolStats{Depth: s.depth, Bytes: s.bytes}
+	for _, segment := range s.segments {
+		if !segment.oldest.IsZero() {
+			stats.Oldest = segment.oldest
+			stats.Age = time.Since(segment.oldest)
+			break
+		}
+	}
+	return stats
+}
+
+// Close stops the replay worker and seals the current segment
+func (s *spool) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.seal()
+}
+
+// retryable reports whether a failed delivery is worth spooling: a transient error, or an open
+// circuit. Permanent errors, such as a missing webhook URL or an unknown channel, would fail again.
+func retryable(err error) bool {
+	return types.IsTransient(err) || errors.Is(err, ErrCircuitOpen)
+}
+
+// spoolAlert appends an alert that could not be delivered to the spool
+func (l *Logger) spoolAlert(alert *types.Alert, providerName, channel string) {
+	spooled := *alert
+	spooled.Attachments = make([]types.Attachment, len(alert.Attachments))
+	for i, attachment := range alert.Attachments {
+		attachment.Reader = nil
+		spooled.Attachments[i] = attachment
+	}
+	record := spoolRecord{Provider: providerName, Channel: channel, SpooledAt: time.Now(), Alert: &spooled}
+	if err := l.resources.spool.append(record); err != nil {
+		fmt.Printf("[commonlog] Warning: failed to spool alert to %s channel %s: %v\n", providerName, channel, err)
+		return
+	}
+	types.DebugLog(l.config, "spool: alert to %s channel %s spooled for replay", providerName, channel)
+}
+
+// replaySpooled delivers a spooled alert within its channel's rate limit. Partial failures count
+// as delivered, and alerts that fail with a permanent error are dropped with a warning, so that
+// they do not hold up the rest of the spool.
+func (l *Logger) replaySpooled(ctx context.Context, record spoolRecord) error {
+	provider := l.provider
+	if record.Provider != l.config.Provider {
+		provider = l.customProvider(record.Provider)
+	}
+	if limit := l.config.RateLimitFor(record.Provider); limit.Rate > 0 {
+		if err := l.resources.limiter.wait(ctx, record.Provider+"\x00"+record.Channel, limit); err != nil {
+			return err
+		}
+	}
+	result, err := l.attemptDelivery(ctx, provider, record.Provider, record.Alert, record.Channel, nil)
+	if result != nil || err == nil {
+		return nil
+	}
+	if ctx.Err() == nil && !retryable(err) {
+		fmt.Printf("[commonlog] Warning: dropped spooled alert to %s channel %s: %v\n", record.Provider, record.Channel, err)
+		return nil
+	}
+	return err
+}
+
+// SpoolStats returns the depth and age of the spool, or zero stats when Spool.Dir is unset
+func (l *Logger) SpoolStats() SpoolStats {
+	if l.resources.spool == nil {
+		return SpoolStats{}
+	}
+	return l.resources.spool.stats()
+}
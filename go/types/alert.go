@@ -0,0 +1,112 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+// Alert is a single alert as delivered by a Provider
+type Alert struct {
+	Level       Level
+	Title       string                 // Optional title; providers default to "service - environment"
+	Message     string                 // Alert body
+	Fields      map[string]interface{} // Structured key-value metadata, rendered as fields
+	Attachments []Attachment           // Files and links attached to the alert
+	Trace       string                 // Optional trace log, delivered as its own "trace.log" attachment
+	DedupKey    string                 // Optional key identifying repeats of the same alert
+	Timestamp   time.Time              // When the alert occurred
+	Labels      map[string]string      // Optional routing and grouping labels, not rendered in chat messages
+	ThreadRef   *MessageRef            // When set, the alert is posted as a reply in this message's thread
+}
+
+// Target describes where and how a Provider delivers an alert
+type Target struct {
+	Channel string // Resolved channel; empty uses the provider's default destination
+	Config  Config // Configuration of the Logger delivering the alert
+	// Replace, when set, edits the referenced message in place instead of posting a new one
+	Replace *MessageRef
+}
+
+// DeliveryResult describes a delivered alert. Providers return both a result and an error when the
+// message was delivered but some of its attachments were not.
+type DeliveryResult struct {
+	Provider string      // Provider that delivered the alert
+	Channel  string      // Channel the alert was delivered to
+	Ref      *MessageRef // Reference to the delivered message, nil when the provider does not report one
+}
+
+// Provider interface for alert providers
+type Provider interface {
+	Deliver(ctx context.Context, alert *Alert, target Target) (*DeliveryResult, error)
+}
+
+// LegacyProvider is the positional interface implemented by providers before Deliver. The built-in
+// providers still implement it as adapters over Deliver.
+type LegacyProvider interface {
+	Send(level Level, message string, attachment *Attachment, cfg Config) error
+	SendToChannel(level Level, message string, attachment *Attachment, cfg Config, channel string) error
+}
+
+// ThreadedProvider is implemented by providers that can reply to and update delivered messages.
+// Its methods are adapters over Deliver with Alert.ThreadRef and Target.Replace.
+type ThreadedProvider interface {
+	SendWithRef(level Level, message string, attachment *Attachment, cfg Config, channel string) (*MessageRef, error)
+	Reply(ref *MessageRef, level Level, message string, attachment *Attachment, cfg Config) (*MessageRef, error)
+	Update(ref *MessageRef, level Level, message string, attachment *Attachment, cfg Config) error
+}
+
+// NewAlert builds an alert from the positional arguments of the legacy provider methods,
+// taking its fields from cfg
+func NewAlert(level Level, message string, attachment *Attachment, cfg Config) *Alert {
+	alert := &Alert{
+		Level:     level,
+		Message:   message,
+		Fields:    cfg.Fields,
+		Timestamp: time.Now(),
+	}
+	if attachment != nil {
+		alert.Attachments = []Attachment{*attachment}
+	}
+	return alert
+}
+
+// TraceFileName is the file name of the attachment holding an alert's trace
+const TraceFileName = "trace.log"
+
+// AllAttachments returns the alert's attachments followed by its trace, if any, as a text attachment
+func (a *Alert) AllAttachments() []Attachment {
+	if a.Trace == "" {
+		return a.Attachments
+	}
+	all := make([]Attachment, 0, len(a.Attachments)+1)
+	all = append(all, a.Attachments...)
+	return append(all, Attachment{FileName: TraceFileName, ContentType: "text/plain; charset=utf-8", Content: a.Trace})
+}
+
+// LoadAttachments reads the content of every Reader attachment into memory. It replaces the
+// Attachments slice instead of modifying it, so the caller's attachments are left untouched.
+func (a *Alert) LoadAttachments() error {
+	loaded := make([]Attachment, len(a.Attachments))
+	for i, attachment := range a.Attachments {
+		var err error
+		if loaded[i], err = attachment.Load(); err != nil {
+			return err
+		}
+	}
+	a.Attachments = loaded
+	return nil
+}
+
+// TitleOrDefault returns the alert title, or "service - environment" from cfg when it is empty
+func (a *Alert) TitleOrDefault(cfg Config) string {
+	if a.Title != "" {
+		return a.Title
+	}
+	if cfg.ServiceName != "" && cfg.Environment != "" {
+		return cfg.ServiceName + " - " + cfg.Environment
+	}
+	if cfg.ServiceName != "" {
+		return cfg.ServiceName
+	}
+	return cfg.Environment
+}
@@ -0,0 +1,170 @@
+package types
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// DefaultHTTPTimeout bounds each provider request when HTTP.Timeout is unset
+const DefaultHTTPTimeout = 30 * time.Second
+
+// defaultHTTPClient is used by providers outside a Logger when no HTTP client is configured
+var defaultHTTPClient = &http.Client{Timeout: DefaultHTTPTimeout}
+
+// HTTPConfig configures the HTTP client used by providers. A Client is used as is; otherwise
+// NewLogger builds one from the remaining options and reuses it for every request.
+type HTTPConfig struct {
+	Client         *http.Client      // Complete client to use; the options below are then ignored
+	Transport      http.RoundTripper // Transport for the built client (defaults to a clone of http.DefaultTransport)
+	Timeout        time.Duration     // Per-request timeout, including reading the response (defaults to 30s)
+	ProxyURL       string            // Egress proxy, e.g. "http://proxy.internal:3128" (defaults to HTTP_PROXY/HTTPS_PROXY)
+	CAFile         string            // PEM bundle of CAs to trust in addition to the system pool
+	CAPEM          []byte            // PEM CAs to trust, as CAFile
+	ClientCertFile string            // PEM client certificate for mutual TLS
+	ClientKeyFile  string            // PEM key of ClientCertFile
+	TLSConfig      *tls.Config       // Base TLS settings, extended with the CAs and client certificate
+	UserAgent      string            // Overrides the default User-Agent
+}
+
+// NewClient builds an HTTP client from the options. The proxy and TLS options require the default
+// transport, and are rejected with a custom Transport.
+func (c HTTPConfig) NewClient() (*http.Client, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	custom := c.ProxyURL != "" || c.CAFile != "" || len(c.CAPEM) > 0 || c.ClientCertFile != "" || c.TLSConfig != nil
+	if c.Transport != nil {
+		if custom {
+			return nil, fmt.Errorf("HTTP proxy and TLS options cannot be combined with a custom Transport")
+		}
+		return &http.Client{Transport: c.Transport, Timeout: timeout}, nil
+	}
+	if !custom {
+		return &http.Client{Timeout: timeout}, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// tlsConfig extends TLSConfig with the configured CAs and client certificate
+func (c HTTPConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSConfig != nil {
+		tlsConfig = c.TLSConfig.Clone()
+	}
+	if c.CAFile != "" || len(c.CAPEM) > 0 {
+		pool := tlsConfig.RootCAs
+		if pool == nil {
+			var err error
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		}
+		pem := c.CAPEM
+		if c.CAFile != "" {
+			data, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %w", err)
+			}
+			pem = append(append([]byte{}, pem...), data...)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in CAFile or CAPEM")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	return tlsConfig, nil
+}
+
+// HTTPClient returns the client providers send requests with
+func (c Config) HTTPClient() *http.Client {
+	if c.HTTP.Client != nil {
+		return c.HTTP.Client
+	}
+	return defaultHTTPClient
+}
+
+// UserAgent returns the User-Agent of provider requests, identifying commonlog and the service
+func (c Config) UserAgent() string {
+	if c.HTTP.UserAgent != "" {
+		return c.HTTP.UserAgent
+	}
+	switch {
+	case c.ServiceName != "" && c.Environment != "":
+		return fmt.Sprintf("commonlog-go (%s; %s)", c.ServiceName, c.Environment)
+	case c.ServiceName != "":
+		return fmt.Sprintf("commonlog-go (%s)", c.ServiceName)
+	default:
+		return "commonlog-go"
+	}
+}
+
+// DoHTTP sends a provider request with the configured client and User-Agent
+func (c Config) DoHTTP(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", c.UserAgent())
+	return c.HTTPClient().Do(req)
+}
+
+// HTTPStatusError is returned by providers for an unsuccessful HTTP response
+type HTTPStatusError struct {
+	Source     string // What responded, e.g. "slack webhook"
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s response: %d", e.Source, e.StatusCode)
+}
+
+// IsTransient reports whether a delivery error may clear up on its own: a timeout, a failed dial or a
+// reset connection, or a 5xx or 429 response. Configuration and API errors, such as an unknown channel,
+// an unsupported URL scheme or an untrusted certificate, are permanent.
+func IsTransient(err error) bool {
+	var status *HTTPStatusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	// *url.Error implements net.Error itself, so look at what it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,150 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Level is the severity of an alert. The zero Level is unset, which lets configuration fall back to defaults.
+type Level int
+
+// Alert levels, from least to most severe
+const (
+	DEBUG Level = iota + 1
+	INFO
+	NOTICE
+	WARN
+	ERROR
+	CRITICAL
+	FATAL
+)
+
+var levelNames = map[Level]string{
+	DEBUG:    "DEBUG",
+	INFO:     "INFO",
+	NOTICE:   "NOTICE",
+	WARN:     "WARN",
+	ERROR:    "ERROR",
+	CRITICAL: "CRITICAL",
+	FATAL:    "FATAL",
+}
+
+// String returns the level name, e.g. "ERROR"
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel parses a level name case-insensitively. "WARNING" and "CRIT" are accepted as aliases.
+func ParseLevel(s string) (Level, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	switch name {
+	case "WARNING":
+		return WARN, nil
+	case "CRIT":
+		return CRITICAL, nil
+	}
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown alert level %q", s)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (l Level) MarshalText() ([]byte, error) {
+	if _, ok := levelNames[l]; !ok {
+		return nil, fmt.Errorf("cannot marshal unknown alert level %d", int(l))
+	}
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// UnmarshalJSON accepts a level name such as "ERROR" or its numeric value
+func (l *Level) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		if _, ok := levelNames[Level(n)]; !ok {
+			return fmt.Errorf("unknown alert level %d", n)
+		}
+		*l = Level(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return l.UnmarshalText([]byte(s))
+}
+
+// Emoji returns the emoji used to mark the level in chat messages
+func (l Level) Emoji() string {
+	switch l {
+	case DEBUG:
+		return "🐛"
+	case INFO:
+		return "ℹ️"
+	case NOTICE:
+		return "📣"
+	case WARN:
+		return "⚠️"
+	case ERROR:
+		return "❌"
+	case CRITICAL:
+		return "🔥"
+	case FATAL:
+		return "💀"
+	default:
+		return "🔔"
+	}
+}
+
+// Color returns the hex color used to mark the level in chat messages
+func (l Level) Color() string {
+	switch l {
+	case DEBUG:
+		return "#9E9E9E"
+	case INFO:
+		return "#2196F3"
+	case NOTICE:
+		return "#00BCD4"
+	case WARN:
+		return "#FFC107"
+	case ERROR:
+		return "#F44336"
+	case CRITICAL:
+		return "#B71C1C"
+	case FATAL:
+		return "#6A1B9A"
+	default:
+		return "#9E9E9E"
+	}
+}
+
+// PagerDutySeverity maps the level to a PagerDuty Events API v2 severity
+func (l Level) PagerDutySeverity() string {
+	switch {
+	case l >= CRITICAL:
+		return "critical"
+	case l == ERROR:
+		return "error"
+	case l == WARN:
+		return "warning"
+	default:
+		return "info"
+	}
+}
@@ -3,15 +3,19 @@
 package types
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"os"
-)
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
-// AlertLevel defines the severity of the alert
-const (
-	INFO = iota
-	WARN
-	ERROR
+	redis "github.com/go-redis/redis/v8"
 )
 
 // DebugLogger provides centralized debug logging
@@ -32,16 +36,16 @@ const (
 
 // ChannelResolver defines an interface for resolving channels based on alert levels
 type ChannelResolver interface {
-	ResolveChannel(level int) string
+	ResolveChannel(level Level) string
 }
 
 // DefaultChannelResolver provides a simple map-based channel resolution
 type DefaultChannelResolver struct {
-	ChannelMap     map[int]string
+	ChannelMap     map[Level]string
 	DefaultChannel string
 }
 
-func (r *DefaultChannelResolver) ResolveChannel(level int) string {
+func (r *DefaultChannelResolver) ResolveChannel(level Level) string {
 	if channel, exists := r.ChannelMap[level]; exists {
 		return channel
 	}
@@ -50,35 +54,320 @@ func (r *DefaultChannelResolver) ResolveChannel(level int) string {
 
 // Config holds configuration for the library
 type Config struct {
-	Provider        string          // "slack" or "lark"
-	SendMethod      string          // "webclient", "webhook", "http"
-	Token           string          // API token for SDK/webclient
-	SlackToken      string          // Slack-specific token
-	LarkToken       LarkTokenConfig // Lark-specific token configuration
-	Channel         string          // Default channel or chat ID (used if no resolver)
-	ChannelResolver ChannelResolver // Optional resolver for dynamic channel mapping
-	ServiceName     string          // Name of the service sending alerts
-	Environment     string          // Environment (dev, staging, production)
-	RedisHost       string          // Redis host for token caching
-	RedisPort       string          // Redis port for token caching
-	Debug           bool            // Enable debug logging for all processes
+	Provider           string                 // "slack" or "lark"
+	SendMethod         string                 // "webclient", "webhook", "http"
+	Token              string                 // API token for SDK/webclient
+	SlackToken         string                 // Slack-specific token
+	LarkToken          LarkTokenConfig        // Lark-specific token configuration
+	Channel            string                 // Default channel or chat ID (used if no resolver)
+	ChannelResolver    ChannelResolver        // Optional resolver for dynamic channel mapping
+	ServiceName        string                 // Name of the service sending alerts
+	Environment        string                 // Environment (dev, staging, production)
+	Cache              Cache                  // Optional cache backend for Lark tokens and chat IDs (defaults to in-process)
+	CacheKeyPrefix     string                 // Namespace for cache keys (defaults to "commonlog")
+	CacheEncryptionKey []byte                 // Optional AES-128/192/256 key to encrypt cached tokens at rest
+	Redis              RedisConfig            // Redis connection options for token caching, used when Cache is nil
+	HTTP               HTTPConfig             // HTTP client, timeout, proxy and TLS options for provider requests
+	LarkChatIDTTL      time.Duration          // How long Lark channel-to-chat_id mappings are cached (defaults to 24h)
+	RedisHost          string                 // Redis host for token caching, used when Cache is nil and Redis.Addrs is empty
+	RedisPort          string                 // Redis port for token caching, used when Cache is nil and Redis.Addrs is empty
+	Fields             map[string]interface{} // Structured fields added to every alert (see Logger.With)
+	MinRemoteLevel     Level                  // Lowest level sent to the provider (defaults to NOTICE); lower levels are only logged locally
+	LocalSink          LocalSink              // Destination for local logs and mirrored alerts (defaults to the standard logger)
+	BatchMaxLevel      Level                  // Alerts up to this level are combined into per-channel digests; zero disables batching
+	BatchInterval      time.Duration          // How long alerts are buffered before their digest is sent (defaults to 1m)
+	BatchSize          int                    // Buffered alerts that trigger an early digest (defaults to 100)
+	RateLimits         map[string]RateLimit   // Per-channel send limits by provider name, overriding DefaultRateLimits
+	RateLimitPolicy    string                 // Handling of alerts over the limit: RateLimitQueue (default), RateLimitDrop or RateLimitSummarize
+	RateLimitMaxWait   time.Duration          // Longest RateLimitQueue waits before collapsing an alert into a summary (defaults to 5s)
+	AsyncQueueSize     int                    // Alerts buffered by DeliverAsync, which drops alerts beyond it (defaults to 256)
+	CircuitBreaker     CircuitBreakerConfig   // Fail fast, or fail over, while a provider endpoint is failing
+	Spool              SpoolConfig            // Optional on-disk spool replaying alerts that could not be delivered
+	DumpAllGoroutines  bool                   // FATAL alerts from SendError and Recover include a stack dump of all goroutines
+	DedupWindow        time.Duration          // Suppress repeats of an alert for this long, then send a digest; zero disables
+	DedupFingerprint   func(*Alert) string    // Identifies repeats (defaults to the DedupKey, or level, service and message template)
+	DedupStore         Counter                // Repeat counts, e.g. cache.NewRedis to share across replicas (defaults to in-process)
+	Debug              bool                   // Enable debug logging for all processes
+}
+
+// ConfigError lists every missing or invalid configuration key
+type ConfigError struct {
+	Missing []string // Required keys that are unset
+	Invalid []string // Keys with invalid values, each followed by the reason
+}
+
+func (e *ConfigError) Error() string {
+	var parts []string
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		parts = append(parts, "invalid "+strings.Join(e.Invalid, "; "))
+	}
+	return "commonlog: invalid config: " + strings.Join(parts, "; ")
+}
+
+// RateLimit is a token bucket limiting the alerts sent to one channel of a provider
+type RateLimit struct {
+	Rate  float64 // Alerts per second; zero disables limiting
+	Burst int     // Alerts that may be sent at once (defaults to 1)
+}
+
+// DefaultRateLimits follow the documented per-channel limits: Slack allows about one message per
+// second per channel, and Lark allows five messages per second to the same chat
+var DefaultRateLimits = map[string]RateLimit{
+	"slack": {Rate: 1, Burst: 1},
+	"lark":  {Rate: 5, Burst: 5},
+}
+
+// Rate limit policies for alerts over the limit
+const (
+	RateLimitQueue     = "queue"     // Wait for the limit, up to RateLimitMaxWait or the context deadline
+	RateLimitDrop      = "drop"      // Log the alert locally only
+	RateLimitSummarize = "summarize" // Log locally and send a summary once the limit allows
+)
+
+// RateLimitFor returns the rate limit for a provider
+func (c Config) RateLimitFor(provider string) RateLimit {
+	if limit, ok := c.RateLimits[provider]; ok {
+		return limit
+	}
+	return DefaultRateLimits[provider]
+}
+
+// SpoolConfig configures the on-disk spool. Alerts that could not be delivered are appended to
+// segment files in Dir and replayed in order by a background worker, including after a restart.
+// Dir is not locked: it must be owned by a single Logger in a single process, since two owners would
+// replay and delete each other's segments.
+type SpoolConfig struct {
+	Dir           string        // Spool directory, owned by one Logger in one process; empty disables the spool
+	SegmentSize   int64         // Size at which a new segment file is started (defaults to 4 MiB)
+	MaxSize       int64         // Total size of the spool; alerts beyond it are dropped (defaults to 64 MiB)
+	Sync          string        // Fsync policy: SpoolSyncAlways (default), SpoolSyncInterval or SpoolSyncNever
+	SyncInterval  time.Duration // How often the spool is synced with SpoolSyncInterval (defaults to 1s)
+	RetryInterval time.Duration // How often the worker retries spooled alerts (defaults to 30s)
+}
+
+// Spool fsync policies
+const (
+	SpoolSyncAlways   = "always"   // Sync after every spooled alert
+	SpoolSyncInterval = "interval" // Sync every SyncInterval
+	SpoolSyncNever    = "never"    // Leave syncing to the operating system
+)
+
+// CircuitBreakerConfig configures the circuit breaker kept per provider endpoint. After
+// FailureThreshold consecutive failed deliveries the circuit opens and alerts fail fast, or go to
+// Failover, until OpenTimeout has passed; the next delivery is then a trial that closes the circuit
+// on success or opens it again on failure.
+type CircuitBreakerConfig struct {
+	FailureThreshold int                                          // Consecutive failures that open the circuit; zero disables the breaker
+	OpenTimeout      time.Duration                                // How long the circuit stays open before a trial delivery (defaults to 30s)
+	Failover         *Config                                      // Optional destination for alerts while the circuit is open
+	OnStateChange    func(endpoint string, from, to CircuitState) // Optional hook called on every state change
+}
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+// Circuit breaker states
+const (
+	CircuitClosed   CircuitState = iota // Deliveries go through
+	CircuitOpen                         // Deliveries fail fast
+	CircuitHalfOpen                     // One trial delivery decides whether the circuit closes
+)
+
+// String returns the name of the state
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// DefaultMinRemoteLevel is the lowest level sent to the provider when MinRemoteLevel is unset
+const DefaultMinRemoteLevel = NOTICE
+
+// RemoteLevel returns the lowest level sent to the provider
+func (c Config) RemoteLevel() Level {
+	if c.MinRemoteLevel == 0 {
+		return DefaultMinRemoteLevel
+	}
+	return c.MinRemoteLevel
+}
+
+// LocalRecord is an alert as written to a LocalSink
+type LocalRecord struct {
+	Time        time.Time
+	Level       Level
+	Message     string
+	Service     string
+	Environment string
+	Provider    string
+	Channel     string
+	Fields      map[string]interface{}
+	Remote      bool  // Whether the alert was sent to the provider
+	Error       error // Remote delivery error, if any
+}
+
+// SortedFieldKeys returns the keys of fields in sorted order, for stable rendering
+func SortedFieldKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LocalSink receives every alert: messages below MinRemoteLevel, and a mirror of each remote alert
+type LocalSink interface {
+	Log(ctx context.Context, record LocalRecord) error
+}
+
+// Lark open platform domains
+const (
+	LarkDomainLark   = "https://open.larksuite.com" // Lark (international)
+	LarkDomainFeishu = "https://open.feishu.cn"     // Feishu (mainland China)
+)
+
+// Lark receive_id_type values. A Lark channel of the form "<type>:<id>", e.g. "email:oncall@example.com",
+// is sent directly to that receiver; any other channel is treated as a chat name and resolved to a chat_id.
+const (
+	LarkReceiveChatID  = "chat_id"
+	LarkReceiveOpenID  = "open_id"
+	LarkReceiveUserID  = "user_id"
+	LarkReceiveUnionID = "union_id"
+	LarkReceiveEmail   = "email"
+)
+
+// LarkReceiver formats a Lark channel that addresses a receiver directly by ID type
+func LarkReceiver(idType, id string) string {
+	return idType + ":" + id
+}
+
+// Cache stores short-lived values such as Lark tenant access tokens and chat IDs
+type Cache interface {
+	// Get returns the cached value and whether it was found
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set stores a value; a ttl of zero means no expiry
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Delete removes a value
+	Delete(ctx context.Context, key string) error
+}
+
+// Counter stores atomic counters, such as the repeat counts used for deduplication. The built-in
+// cache backends implement it; the Redis backend shares counts across replicas.
+type Counter interface {
+	// Incr increments the counter at key and returns its new value. A ttl is applied when the
+	// counter is created; zero means no expiry.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Take returns the counter at key and deletes it, returning zero if it does not exist
+	Take(ctx context.Context, key string) (int64, error)
+}
+
+// RedisConfig holds Redis connection options
+type RedisConfig struct {
+	Addrs      []string              // host:port addresses; several addresses without MasterName select a Cluster client
+	MasterName string                // Sentinel master name; Addrs are then the Sentinel addresses
+	Username   string                // ACL username
+	Password   string                // Password or ACL password
+	DB         int                   // Database index (single node and Sentinel only)
+	TLSConfig  *tls.Config           // Enables TLS when set
+	Client     redis.UniversalClient // Pre-built client; takes precedence over other options and is not closed by commonlog
+}
+
+// RedisOptions returns the Redis client options for cfg, or nil if Redis is not configured.
+// Redis.Addrs takes precedence over RedisHost/RedisPort.
+func (c Config) RedisOptions() *redis.UniversalOptions {
+	addrs := c.Redis.Addrs
+	if len(addrs) == 0 {
+		if c.RedisHost == "" || c.RedisPort == "" {
+			return nil
+		}
+		addrs = []string{c.RedisHost + ":" + c.RedisPort}
+	}
+	return &redis.UniversalOptions{
+		Addrs:      addrs,
+		MasterName: c.Redis.MasterName,
+		Username:   c.Redis.Username,
+		Password:   c.Redis.Password,
+		DB:         c.Redis.DB,
+		TLSConfig:  c.Redis.TLSConfig,
+	}
 }
 
 // LarkTokenConfig holds Lark app credentials
 type LarkTokenConfig struct {
 	AppID     string
 	AppSecret string
+	Domain    string // LarkDomainLark (default), LarkDomainFeishu, or a custom base URL
 }
 
-// Attachment represents a file attachment
+// APIBaseURL returns the open-apis base URL for the configured domain
+func (c LarkTokenConfig) APIBaseURL() string {
+	domain := c.Domain
+	if domain == "" {
+		domain = LarkDomainLark
+	}
+	return strings.TrimSuffix(domain, "/") + "/open-apis"
+}
+
+// Attachment represents a file attachment. Text in Content is rendered inline; raw Data or a Reader
+// is uploaded as a file by providers that support uploads.
 type Attachment struct {
-	URL      string // Public URL for external files
-	FileName string // Optional file name
-	Content  string // Inline content for text attachments
+	URL         string    // Public URL for external files
+	FileName    string    // Optional file name
+	Content     string    // Inline content for text attachments
+	ContentType string    // Optional MIME type; defaults from the file name extension
+	Data        []byte    // Raw file content
+	Reader      io.Reader // File content read once when the alert is delivered, instead of Data
+	Size        int64     // Size of the file content in bytes, if known
+}
+
+// IsFile reports whether the attachment carries file content to upload
+func (a Attachment) IsFile() bool {
+	return a.Data != nil || a.Reader != nil
+}
+
+// MIMEType returns the content type, derived from the file name when ContentType is empty
+func (a Attachment) MIMEType() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(a.FileName)); t != "" {
+		return t
+	}
+	if a.Content != "" && !a.IsFile() {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// Load returns a copy of the attachment with Reader read into Data and Size set,
+// so that the content can be sent more than once
+func (a Attachment) Load() (Attachment, error) {
+	if a.Reader != nil {
+		data, err := io.ReadAll(a.Reader)
+		if err != nil {
+			return a, fmt.Errorf("failed to read attachment %q: %w", a.FileName, err)
+		}
+		a.Data, a.Reader = data, nil
+	}
+	if a.Data != nil {
+		a.Size = int64(len(a.Data))
+	}
+	return a, nil
 }
 
-// Provider interface for alert providers
-type Provider interface {
-	Send(level int, message string, attachment *Attachment, cfg Config) error
-	SendToChannel(level int, message string, attachment *Attachment, cfg Config, channel string) error
+// MessageRef identifies a delivered message so that it can be replied to or updated
+type MessageRef struct {
+	Provider  string // Provider that delivered the message ("slack" or "lark")
+	Channel   string // Channel or chat the message was delivered to
+	MessageID string // Lark message_id or Slack message ts
 }
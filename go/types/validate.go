@@ -0,0 +1,150 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Validate reports every missing or inconsistent setting in a *ConfigError, such as a webclient
+// send method configured with only a webhook URL, or a Slack or Lark config without a send method.
+// Keys are Config field names.
+func (c Config) Validate() error {
+	var err ConfigError
+	c.validate("", &err)
+	if len(err.Missing) > 0 || len(err.Invalid) > 0 {
+		return &err
+	}
+	return nil
+}
+
+// validate adds the problems of c to err, with keys prefixed by prefix
+func (c Config) validate(prefix string, err *ConfigError) {
+	missing := func(key string) { err.Missing = append(err.Missing, prefix+key) }
+	invalid := func(key, format string, args ...interface{}) {
+		err.Invalid = append(err.Invalid, prefix+key+": "+fmt.Sprintf(format, args...))
+	}
+
+	method := c.SendMethod
+	if method == "" {
+		method = MethodWebClient
+	}
+	switch method {
+	case MethodWebClient, MethodWebhook:
+	default:
+		invalid("SendMethod", "%q is not one of webclient or webhook", c.SendMethod)
+	}
+
+	switch c.Provider {
+	case "":
+		missing("Provider")
+	case "generic":
+		if c.Token == "" {
+			missing("Token")
+		} else if !isURL(c.Token) {
+			invalid("Token", "the generic provider requires a webhook URL")
+		}
+	case "slack", "lark":
+		// The providers reject an empty send method
+		if c.SendMethod == "" {
+			missing("SendMethod")
+		}
+		if method == MethodWebhook {
+			if c.Token == "" {
+				missing("Token")
+			} else if !isURL(c.Token) {
+				invalid("Token", "SendMethod webhook requires a webhook URL")
+			}
+			break
+		}
+		if isURL(c.Token) {
+			invalid("Token", "SendMethod webclient is configured with a webhook URL; use SendMethod webhook")
+		}
+		if c.Provider == "slack" && c.Token == "" && c.SlackToken == "" {
+			missing("Token or SlackToken")
+		}
+		if c.Provider == "lark" && c.Token == "" && c.LarkToken.AppID == "" && c.LarkToken.AppSecret == "" {
+			missing("Token or LarkToken.AppID and LarkToken.AppSecret")
+		}
+	default:
+		invalid("Provider", "%q is not one of slack, lark or generic", c.Provider)
+	}
+	if (c.LarkToken.AppID == "") != (c.LarkToken.AppSecret == "") {
+		if c.LarkToken.AppID == "" {
+			missing("LarkToken.AppID")
+		} else {
+			missing("LarkToken.AppSecret")
+		}
+	}
+
+	if (c.RedisHost == "") != (c.RedisPort == "") {
+		if c.RedisHost == "" {
+			missing("RedisHost")
+		} else {
+			missing("RedisPort")
+		}
+	}
+	if len(c.CacheEncryptionKey) > 0 {
+		switch len(c.CacheEncryptionKey) {
+		case 16, 24, 32:
+		default:
+			invalid("CacheEncryptionKey", "must be 16, 24 or 32 bytes, got %d", len(c.CacheEncryptionKey))
+		}
+	}
+
+	switch c.RateLimitPolicy {
+	case "", RateLimitQueue, RateLimitDrop, RateLimitSummarize:
+	default:
+		invalid("RateLimitPolicy", "%q is not one of queue, drop or summarize", c.RateLimitPolicy)
+	}
+	if c.RateLimitMaxWait < 0 {
+		invalid("RateLimitMaxWait", "must not be negative")
+	}
+	for provider, limit := range c.RateLimits {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			invalid("RateLimits."+provider, "rate and burst must not be negative")
+		}
+	}
+	if c.AsyncQueueSize < 0 {
+		invalid("AsyncQueueSize", "must not be negative")
+	}
+	if c.BatchSize < 0 {
+		invalid("BatchSize", "must not be negative")
+	}
+	if c.CircuitBreaker.FailureThreshold < 0 {
+		invalid("CircuitBreaker.FailureThreshold", "must not be negative")
+	}
+	if failover := c.CircuitBreaker.Failover; failover != nil {
+		failover.validate(prefix+"CircuitBreaker.Failover.", err)
+	}
+	switch c.Spool.Sync {
+	case "", SpoolSyncAlways, SpoolSyncInterval, SpoolSyncNever:
+	default:
+		invalid("Spool.Sync", "%q is not one of always, interval or never", c.Spool.Sync)
+	}
+	if c.Spool.SegmentSize > 0 && c.Spool.MaxSize > 0 && c.Spool.SegmentSize > c.Spool.MaxSize {
+		invalid("Spool.SegmentSize", "is larger than Spool.MaxSize")
+	}
+	problems := len(err.Missing) + len(err.Invalid)
+	if c.HTTP.Transport != nil && (c.HTTP.ProxyURL != "" || c.HTTP.CAFile != "" || len(c.HTTP.CAPEM) > 0 ||
+		c.HTTP.ClientCertFile != "" || c.HTTP.TLSConfig != nil) {
+		invalid("HTTP.Transport", "cannot be combined with proxy or TLS options")
+	}
+	if (c.HTTP.ClientCertFile == "") != (c.HTTP.ClientKeyFile == "") {
+		if c.HTTP.ClientCertFile == "" {
+			missing("HTTP.ClientCertFile")
+		} else {
+			missing("HTTP.ClientKeyFile")
+		}
+	}
+	// Building the client checks the proxy URL, CA bundle and client certificate
+	if c.HTTP.Client == nil && problems == len(err.Missing)+len(err.Invalid) {
+		if _, clientErr := c.HTTP.NewClient(); clientErr != nil {
+			invalid("HTTP", "%v", clientErr)
+		}
+	}
+}
+
+// isURL reports whether s is an http or https URL
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
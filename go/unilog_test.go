@@ -1,8 +1,33 @@
 package commonlog
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/alicebob/miniredis/v2"
+	redis "github.com/go-redis/redis/v8"
+
+	"github.com/alvianhanif/commonlog/go/cache"
+	"github.com/alvianhanif/commonlog/go/providers"
 	"github.com/alvianhanif/commonlog/go/types"
 )
 
@@ -185,7 +210,7 @@ func TestCustomSendUnknownProvider(t *testing.T) {
 
 func TestResolveChannelWithResolver(t *testing.T) {
 	resolver := &types.DefaultChannelResolver{
-		ChannelMap:     map[int]string{types.ERROR: "#errors", types.WARN: "#warnings"},
+		ChannelMap:     map[types.Level]string{types.ERROR: "#errors", types.WARN: "#warnings"},
 		DefaultChannel: "#general",
 	}
 	cfg := types.Config{
@@ -230,3 +255,2490 @@ func TestResolveChannelWithoutResolver(t *testing.T) {
 		t.Errorf("Expected #default, got %s", channel)
 	}
 }
+
+func TestLarkAPIBaseURL(t *testing.T) {
+	cases := map[string]string{
+		"":                       "https://open.larksuite.com/open-apis",
+		types.LarkDomainFeishu:   "https://open.feishu.cn/open-apis",
+		"http://127.0.0.1:8080/": "http://127.0.0.1:8080/open-apis",
+	}
+	for domain, want := range cases {
+		got := types.LarkTokenConfig{Domain: domain}.APIBaseURL()
+		if got != want {
+			t.Errorf("Domain %q: expected %s, got %s", domain, want, got)
+		}
+	}
+}
+
+func TestSendWithRefInfo(t *testing.T) {
+	logger := NewLogger(types.Config{})
+	ref, err := logger.SendWithRef(types.INFO, "Test info message", nil, "", "")
+	if err != nil || ref != nil {
+		t.Errorf("Expected nil ref and no error for INFO level, got %v, %v", ref, err)
+	}
+}
+
+func TestReplyAndUpdateRequireWebClient(t *testing.T) {
+	for _, provider := range []string{"slack", "lark"} {
+		logger := NewLogger(types.Config{
+			Provider:   provider,
+			SendMethod: types.MethodWebhook,
+			Token:      "dummy-token",
+		})
+		ref := &types.MessageRef{Provider: provider, Channel: "#test", MessageID: "123"}
+		if _, err := logger.Reply(ref, types.ERROR, "Follow-up", nil, ""); err == nil {
+			t.Errorf("%s: expected error replying with webhook method, got none", provider)
+		}
+		if err := logger.Update(ref, types.INFO, "Resolved", nil, ""); err == nil {
+			t.Errorf("%s: expected error updating with webhook method, got none", provider)
+		}
+	}
+}
+
+func TestLarkWebClientDirectReceiver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/open-apis/im/v1/messages" {
+			t.Errorf("Unexpected request path %s", r.URL.Path)
+		}
+		if got := r.URL.Query().Get("receive_id_type"); got != types.LarkReceiveEmail {
+			t.Errorf("Expected receive_id_type email, got %s", got)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["receive_id"] != "oncall@example.com" {
+			t.Errorf("Expected receive_id oncall@example.com, got %v", body["receive_id"])
+		}
+		w.Write([]byte(`{"code":0,"msg":"success","data":{"message_id":"om_123"}}`))
+	}))
+	defer server.Close()
+
+	logger := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		Token:      "tenant-token",
+		LarkToken:  types.LarkTokenConfig{Domain: server.URL},
+	})
+	channel := types.LarkReceiver(types.LarkReceiveEmail, "oncall@example.com")
+	ref, err := logger.SendWithRef(types.ERROR, "Direct message", nil, "", channel)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if ref == nil || ref.MessageID != "om_123" {
+		t.Errorf("Expected message_id om_123, got %+v", ref)
+	}
+}
+
+// fakeLark is an in-process Lark open API serving tokens, a chat list, message sends and card updates
+type fakeLark struct {
+	*httptest.Server
+	tokenCalls  int32
+	chatCalls   int32
+	sendCalls   int32
+	updateCalls int32
+	sharedCard  atomic.Bool // the sent card set update_multi, so that it can be updated
+	rejectSends int32       // number of sends to reject with an invalid token error
+	chats       []string    // chat list as alternating chat_id and name, one chat per page
+	goneChatID  string      // chat_id rejected as "bot not in chat"
+}
+
+func newFakeLark(t *testing.T) *fakeLark {
+	f := &fakeLark{chats: []string{"oc_alerts", "alerts"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/open-apis/auth/v3/tenant_access_token/internal", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.tokenCalls, 1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"code":0,"msg":"ok","tenant_access_token":"t-fake","expire":7200}`))
+	})
+	mux.HandleFunc("/open-apis/im/v1/chats", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.chatCalls, 1)
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("page_token"), &page)
+		data := map[string]interface{}{
+			"items":      []map[string]string{{"chat_id": f.chats[2*page], "name": f.chats[2*page+1]}},
+			"has_more":   2*page+2 < len(f.chats),
+			"page_token": fmt.Sprint(page + 1),
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"code": 0, "msg": "ok", "data": data})
+	})
+	mux.HandleFunc("/open-apis/im/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.sendCalls, 1)
+		if atomic.AddInt32(&f.rejectSends, -1) >= 0 {
+			w.Write([]byte(`{"code":99991663,"msg":"Invalid access token for authorization"}`))
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer t-fake" {
+			t.Errorf("Expected tenant token authorization, got %s", got)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.goneChatID != "" && body["receive_id"] == f.goneChatID {
+			w.Write([]byte(`{"code":230002,"msg":"Bot/User can NOT be out of the chat."}`))
+			return
+		}
+		f.sharedCard.Store(larkUpdateMulti(body["content"]))
+		w.Write([]byte(`{"code":0,"msg":"success","data":{"message_id":"om_1"}}`))
+	})
+	// Like Lark, only cards sent and updated with update_multi can be updated with PATCH
+	mux.HandleFunc("/open-apis/im/v1/messages/om_1", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.updateCalls, 1)
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != "PATCH" || !f.sharedCard.Load() || !larkUpdateMulti(body["content"]) {
+			w.Write([]byte(`{"code":230001,"msg":"only shared cards with update_multi can be updated"}`))
+			return
+		}
+		w.Write([]byte(`{"code":0,"msg":"success","data":{}}`))
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// larkUpdateMulti reports whether the card in a message content string sets config.update_multi
+func larkUpdateMulti(content interface{}) bool {
+	var card struct {
+		Config struct {
+			UpdateMulti bool `json:"update_multi"`
+		} `json:"config"`
+	}
+	s, _ := content.(string)
+	return json.Unmarshal([]byte(s), &card) == nil && card.Config.UpdateMulti
+}
+
+func (f *fakeLark) config(cache types.Cache) types.Config {
+	return types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		LarkToken:  types.LarkTokenConfig{AppID: "cli_test", AppSecret: "secret", Domain: f.URL},
+		Channel:    "alerts",
+		Cache:      cache,
+	}
+}
+
+// failingCache simulates a cache outage
+type failingCache struct{}
+
+func (failingCache) Get(ctx context.Context, key string) (string, bool, error) {
+	return "", false, errors.New("cache down")
+}
+func (failingCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return errors.New("cache down")
+}
+func (failingCache) Delete(ctx context.Context, key string) error { return errors.New("cache down") }
+
+func TestLarkUpdatesSharedCard(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+	cfg := server.config(cache.NewMemory())
+	cfg.LocalSink = NewWriterSink(io.Discard)
+	logger := NewLogger(cfg)
+	defer logger.Close()
+
+	ref, err := logger.SendWithRef(types.ERROR, "Deploy failing", nil, "", "")
+	if err != nil {
+		t.Fatalf("SendWithRef failed: %v", err)
+	}
+	if err := logger.Update(ref, types.INFO, "Deploy recovered", nil, ""); err != nil {
+		t.Fatalf("Expected the shared card to be updated, got %v", err)
+	}
+	if n := atomic.LoadInt32(&server.updateCalls); n != 1 {
+		t.Errorf("Expected 1 update call, got %d", n)
+	}
+}
+
+func TestLarkWebClientWithoutRedis(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	logger := NewLogger(server.config(cache.NewMemory()))
+	for i := 0; i < 2; i++ {
+		if err := logger.Send(types.ERROR, "Cached lookup", nil, ""); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if server.tokenCalls != 1 || server.chatCalls != 1 || server.sendCalls != 2 {
+		t.Errorf("Expected 1 token, 1 chat and 2 send calls, got %d, %d, %d",
+			server.tokenCalls, server.chatCalls, server.sendCalls)
+	}
+}
+
+func TestLarkTokenSingleFlight(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	cfg := server.config(cache.NewMemory())
+	cfg.RateLimits = map[string]types.RateLimit{"lark": {}}
+	logger := NewLogger(cfg)
+	defer logger.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := logger.Send(types.ERROR, "Alert storm", nil, ""); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if server.tokenCalls != 1 || server.chatCalls != 1 {
+		t.Errorf("Expected 1 token and 1 chat call, got %d and %d", server.tokenCalls, server.chatCalls)
+	}
+}
+
+func TestLarkTokenFetchHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	logger := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		LarkToken:  types.LarkTokenConfig{AppID: "cli_hung", AppSecret: "secret", Domain: server.URL},
+		Channel:    "alerts",
+		Cache:      cache.NewMemory(),
+		RateLimits: map[string]types.RateLimit{"lark": {}},
+		LocalSink:  NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	// One delivery fetches the token and another waits for that fetch; both give up with their context
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err := logger.Deliver(ctx, &types.Alert{Level: types.ERROR, Message: "hung token endpoint"}, "")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected the deadline to interrupt the token fetch, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected the delivery to return at its deadline, took %v", elapsed)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLarkInvalidTokenRetry(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+	server.rejectSends = 1
+
+	logger := NewLogger(server.config(cache.NewMemory()))
+	defer logger.Close()
+	if err := logger.Send(types.ERROR, "Retry after refresh", nil, ""); err != nil {
+		t.Fatalf("Expected send to succeed after token refresh, got %v", err)
+	}
+	if server.tokenCalls != 2 || server.sendCalls != 2 {
+		t.Errorf("Expected 2 token and 2 send calls, got %d and %d", server.tokenCalls, server.sendCalls)
+	}
+}
+
+func TestLarkWebClientCacheOutage(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	logger := NewLogger(server.config(failingCache{}))
+	if err := logger.Send(types.ERROR, "Cache is down", nil, ""); err != nil {
+		t.Fatalf("Expected cache outage to fall back to a live fetch, got %v", err)
+	}
+}
+
+func TestNewLoggerSharesRedisClient(t *testing.T) {
+	logger := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		Redis: types.RedisConfig{
+			Addrs:    []string{"127.0.0.1:6379"},
+			Password: "secret",
+			DB:       2,
+		},
+	})
+	if _, ok := logger.config.Cache.(*cache.Redis); !ok {
+		t.Fatalf("Expected a shared Redis cache, got %T", logger.config.Cache)
+	}
+	if err := logger.Close(); err != nil {
+		t.Errorf("Expected no error closing logger, got %v", err)
+	}
+}
+
+func TestRedisOptionsFromHostPort(t *testing.T) {
+	opts := types.Config{RedisHost: "localhost", RedisPort: "6379"}.RedisOptions()
+	if opts == nil || len(opts.Addrs) != 1 || opts.Addrs[0] != "localhost:6379" {
+		t.Errorf("Expected localhost:6379, got %+v", opts)
+	}
+	if opts := (types.Config{}).RedisOptions(); opts != nil {
+		t.Errorf("Expected nil options without Redis configuration, got %+v", opts)
+	}
+}
+
+// recordingCache is an in-process cache that exposes its keys and raw values
+type recordingCache struct {
+	*cache.Memory
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newRecordingCache() *recordingCache {
+	return &recordingCache{Memory: cache.NewMemory(), values: make(map[string]string)}
+}
+
+func (c *recordingCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	c.mu.Lock()
+	c.values[key] = value
+	c.mu.Unlock()
+	return c.Memory.Set(ctx, key, value, ttl)
+}
+
+func (c *recordingCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+	return c.Memory.Delete(ctx, key)
+}
+
+func TestLarkTokenCacheKeysHideSecret(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	recorder := newRecordingCache()
+	cfg := server.config(recorder)
+	cfg.CacheKeyPrefix = "myapp"
+	cfg.CacheEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	logger := NewLogger(cfg)
+	defer logger.Close()
+
+	if err := logger.Send(types.ERROR, "Hashed keys", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for key, value := range recorder.values {
+		if strings.Contains(key, "secret") {
+			t.Errorf("Cache key %q contains the app secret", key)
+		}
+		if !strings.HasPrefix(key, "myapp:") {
+			t.Errorf("Cache key %q does not use the configured prefix", key)
+		}
+		if strings.Contains(value, "t-fake") {
+			t.Errorf("Cache value for %q contains the plaintext token", key)
+		}
+	}
+}
+
+func TestLarkLegacyTokenMigration(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	recorder := newRecordingCache()
+	legacyKey := "commonlog_lark_token:cli_test:secret"
+	recorder.Set(context.Background(), legacyKey, "t-fake", time.Hour)
+
+	logger := NewLogger(server.config(recorder))
+	defer logger.Close()
+	if err := logger.Send(types.ERROR, "Legacy token", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if server.tokenCalls != 0 {
+		t.Errorf("Expected the legacy cached token to be used, got %d token calls", server.tokenCalls)
+	}
+	if _, ok := recorder.values[legacyKey]; ok {
+		t.Error("Expected the legacy token key to be removed after migration")
+	}
+}
+
+func TestLarkLegacyTokenMigrationEncrypts(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	recorder := newRecordingCache()
+	legacyKey := "commonlog_lark_token:cli_test:secret"
+	recorder.Set(context.Background(), legacyKey, "t-fake", time.Hour)
+
+	cfg := server.config(recorder)
+	cfg.CacheEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	logger := NewLogger(cfg)
+	defer logger.Close()
+	if err := logger.Send(types.ERROR, "Legacy token", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if server.tokenCalls != 0 {
+		t.Errorf("Expected the legacy cached token to be used, got %d token calls", server.tokenCalls)
+	}
+	if len(recorder.values) == 0 {
+		t.Fatal("Expected the legacy token to be migrated")
+	}
+	for key, value := range recorder.values {
+		if strings.Contains(value, "t-fake") {
+			t.Errorf("Migrated cache value for %q contains the plaintext token", key)
+		}
+	}
+}
+
+func TestLarkStaleChatIDInvalidated(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+
+	recorder := newRecordingCache()
+	logger := NewLogger(server.config(recorder))
+	defer logger.Close()
+	if err := logger.Send(types.ERROR, "Chat lookup", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// The chat was recreated since its chat_id was cached
+	var key string
+	for k := range recorder.values {
+		if strings.Contains(k, ":lark_chat_id:") {
+			key = k
+		}
+	}
+	if key == "" {
+		t.Fatal("Expected the chat_id to be cached")
+	}
+	recorder.Set(context.Background(), key, "oc_old", time.Hour)
+	server.goneChatID = "oc_old"
+	atomic.StoreInt32(&server.chatCalls, 0)
+
+	if err := logger.Send(types.ERROR, "Chat was recreated", nil, ""); err != nil {
+		t.Fatalf("Expected send to succeed after chat_id re-lookup, got %v", err)
+	}
+	if server.chatCalls != 1 {
+		t.Errorf("Expected 1 chat lookup after invalidation, got %d", server.chatCalls)
+	}
+	if chatID, _, _ := recorder.Get(context.Background(), key); chatID != "oc_alerts" {
+		t.Errorf("Expected cached chat_id oc_alerts, got %s", chatID)
+	}
+}
+
+func TestLarkChatIDsScopedPerApp(t *testing.T) {
+	larksuite := newFakeLark(t)
+	defer larksuite.Close()
+	feishu := newFakeLark(t)
+	defer feishu.Close()
+	feishu.chats = []string{"oc_feishu_alerts", "alerts"}
+
+	shared := cache.NewMemory()
+	first := NewLogger(larksuite.config(shared))
+	defer first.Close()
+	cfg := feishu.config(shared)
+	cfg.LarkToken.AppID = "cli_other"
+	second := NewLogger(cfg)
+	defer second.Close()
+
+	if err := first.SyncLarkChats(context.Background()); err != nil {
+		t.Fatalf("Expected no error syncing, got %v", err)
+	}
+	if err := first.Send(types.ERROR, "First app", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := second.Send(types.ERROR, "Second app", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if feishu.chatCalls != 1 {
+		t.Errorf("Expected the second app to look up its own chat_id, got %d chat calls", feishu.chatCalls)
+	}
+}
+
+func TestSyncLarkChats(t *testing.T) {
+	server := newFakeLark(t)
+	defer server.Close()
+	server.chats = []string{"oc_alerts", "alerts", "oc_ops1", "ops", "oc_ops2", "ops"}
+
+	logger := NewLogger(server.config(cache.NewMemory()))
+	defer logger.Close()
+
+	err := logger.SyncLarkChats(context.Background())
+	var duplicates *providers.DuplicateChatNamesError
+	if !errors.As(err, &duplicates) || len(duplicates.Chats["ops"]) != 2 {
+		t.Fatalf("Expected duplicate chat name ops, got %v", err)
+	}
+	if err := logger.Send(types.ERROR, "After sync", nil, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if server.chatCalls != 3 {
+		t.Errorf("Expected only the 3 sync page requests, got %d chat calls", server.chatCalls)
+	}
+}
+
+func TestLevelParseAndMarshal(t *testing.T) {
+	for _, level := range []types.Level{types.DEBUG, types.INFO, types.NOTICE, types.WARN, types.ERROR, types.CRITICAL, types.FATAL} {
+		parsed, err := types.ParseLevel(strings.ToLower(level.String()))
+		if err != nil || parsed != level {
+			t.Errorf("ParseLevel(%s): expected %s, got %s, %v", level, level, parsed, err)
+		}
+		data, err := json.Marshal(level)
+		if err != nil {
+			t.Fatalf("Marshal(%s): %v", level, err)
+		}
+		var decoded types.Level
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded != level {
+			t.Errorf("Unmarshal(%s): expected %s, got %s, %v", data, level, decoded, err)
+		}
+	}
+	if level, err := types.ParseLevel("warning"); err != nil || level != types.WARN {
+		t.Errorf("Expected warning to parse as WARN, got %s, %v", level, err)
+	}
+	if _, err := types.ParseLevel("loud"); err == nil {
+		t.Error("Expected error parsing unknown level")
+	}
+}
+
+func TestLevelPagerDutySeverity(t *testing.T) {
+	cases := map[types.Level]string{
+		types.NOTICE:   "info",
+		types.WARN:     "warning",
+		types.ERROR:    "error",
+		types.FATAL:    "critical",
+		types.CRITICAL: "critical",
+	}
+	for level, want := range cases {
+		if got := level.PagerDutySeverity(); got != want {
+			t.Errorf("%s: expected %s, got %s", level, want, got)
+		}
+	}
+}
+
+func TestSendDebug(t *testing.T) {
+	logger := NewLogger(types.Config{})
+	// DEBUG level should not send, just log
+	if err := logger.Send(types.DEBUG, "Test debug message", nil, ""); err != nil {
+		t.Errorf("Expected no error for DEBUG level, got %v", err)
+	}
+}
+
+func TestMinRemoteLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(types.Config{
+		Provider:       "slack",
+		SendMethod:     types.MethodWebhook,
+		Token:          "dummy-token",
+		MinRemoteLevel: types.ERROR,
+		LocalSink:      NewWriterSink(&buf),
+	})
+	// WARN is below the configured threshold and should only be logged locally
+	if err := logger.Send(types.WARN, "Local warning", nil, ""); err != nil {
+		t.Errorf("Expected no error for WARN below MinRemoteLevel, got %v", err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["level"] != "WARN" || record["message"] != "Local warning" || record["remote"] != false {
+		t.Errorf("Unexpected local record: %v", record)
+	}
+}
+
+func TestRemoteAlertsMirroredLocally(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(types.Config{
+		Provider:    "slack",
+		SendMethod:  types.MethodWebhook,
+		Token:       "dummy-token",
+		Channel:     "#alerts",
+		ServiceName: "billing",
+		LocalSink:   NewLogSink(log.New(&buf, "", 0)),
+	})
+	if err := logger.Send(types.ERROR, "Remote error", nil, ""); err == nil {
+		t.Fatal("Expected error with dummy webhook URL, but got none")
+	}
+	line := buf.String()
+	for _, want := range []string{"[ERROR] Remote error", "remote=true", `service="billing"`, `channel="#alerts"`, "error="} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected mirrored record to contain %q, got %q", want, line)
+		}
+	}
+}
+
+// newCaptureLark serves the Lark messages API and records the content of each message sent
+func newCaptureLark(t *testing.T) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var contents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Content string `json:"content"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		contents = append(contents, body.Content)
+		mu.Unlock()
+		w.Write([]byte(`{"code":0,"msg":"success","data":{"message_id":"om_1"}}`))
+	}))
+	return server, &contents
+}
+
+func TestSlogHandler(t *testing.T) {
+	server, contents := newCaptureLark(t)
+	defer server.Close()
+
+	logger := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		Token:      "tenant-token",
+		Channel:    "chat_id:oc_alerts",
+		LarkToken:  types.LarkTokenConfig{Domain: server.URL},
+		LocalSink:  NewWriterSink(io.Discard),
+	})
+	var buf bytes.Buffer
+	slogger := slog.New(NewSlogHandler(logger, &SlogHandlerOptions{Next: slog.NewTextHandler(&buf, nil)}))
+
+	slogger.Info("request served", "status", 200)
+	slogger.WithGroup("req").Error("payment failed", "id", 42, "err", errors.New("card declined"))
+	logger.Close() // delivers the queued alert
+
+	if !strings.Contains(buf.String(), "request served") || !strings.Contains(buf.String(), "payment failed") {
+		t.Errorf("Expected both records to reach the next handler, got %q", buf.String())
+	}
+	if len(*contents) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(*contents))
+	}
+	for _, want := range []string{"payment failed", "**req.id**", "card declined", "ERROR"} {
+		if !strings.Contains((*contents)[0], want) {
+			t.Errorf("Expected alert to contain %q, got %s", want, (*contents)[0])
+		}
+	}
+}
+
+func TestLoggerWithFields(t *testing.T) {
+	server, contents := newCaptureLark(t)
+	defer server.Close()
+
+	base := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		Token:      "tenant-token",
+		Channel:    "chat_id:oc_alerts",
+		LarkToken:  types.LarkTokenConfig{Domain: server.URL},
+		Fields:     map[string]interface{}{"host": "web-1"},
+		LocalSink:  NewWriterSink(io.Discard),
+	})
+	logger := base.With("request_id", "req-42", "user_id", 7)
+
+	if err := logger.Send(types.ERROR, "checkout failed", nil, ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := base.Send(types.ERROR, "base alert", nil, ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if len(*contents) != 2 {
+		t.Fatalf("Expected 2 alerts, got %d", len(*contents))
+	}
+
+	var card struct {
+		Header struct {
+			Template string `json:"template"`
+		} `json:"header"`
+		Elements []struct {
+			Tag    string `json:"tag"`
+			Fields []struct {
+				Text struct {
+					Content string `json:"content"`
+				} `json:"text"`
+			} `json:"fields"`
+		} `json:"elements"`
+	}
+	if err := json.Unmarshal([]byte((*contents)[0]), &card); err != nil {
+		t.Fatalf("Expected card content, got %s: %v", (*contents)[0], err)
+	}
+	if card.Header.Template != "red" {
+		t.Errorf("Expected red header for ERROR, got %q", card.Header.Template)
+	}
+	var fields []string
+	for _, el := range card.Elements {
+		for _, f := range el.Fields {
+			fields = append(fields, f.Text.Content)
+		}
+	}
+	want := []string{"**host**\nweb-1", "**request_id**\nreq-42", "**user_id**\n7"}
+	if strings.Join(fields, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected fields %q, got %q", want, fields)
+	}
+	if strings.Contains((*contents)[1], "request_id") {
+		t.Errorf("Expected With to leave the base logger unchanged, got %s", (*contents)[1])
+	}
+}
+
+func TestSlackFieldsAsBlocks(t *testing.T) {
+	var payload struct {
+		Attachments []struct {
+			Color  string `json:"color"`
+			Blocks []struct {
+				Type   string `json:"type"`
+				Fields []struct {
+					Text string `json:"text"`
+				} `json:"fields"`
+			} `json:"blocks"`
+		} `json:"attachments"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	fields := make([]interface{}, 0, 24)
+	for i := 0; i < 12; i++ {
+		fields = append(fields, fmt.Sprintf("key%02d", i), i)
+	}
+	logger := NewLogger(types.Config{
+		Provider:   "slack",
+		SendMethod: types.MethodWebhook,
+		Token:      server.URL,
+		LocalSink:  NewWriterSink(io.Discard),
+	}).With(fields...)
+	if err := logger.Send(types.ERROR, "disk full", nil, ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if len(payload.Attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got %d", len(payload.Attachments))
+	}
+	var counts []int
+	for _, block := range payload.Attachments[0].Blocks {
+		if len(block.Fields) > 0 {
+			counts = append(counts, len(block.Fields))
+		}
+	}
+	if fmt.Sprint(counts) != "[10 2]" {
+		t.Errorf("Expected fields split into sections of 10 and 2, got %v", counts)
+	}
+	if got := payload.Attachments[0].Blocks[1].Fields[0].Text; got != "*key00*\n0" {
+		t.Errorf("Expected first field %q, got %q", "*key00*\n0", got)
+	}
+}
+
+func TestGenericProvider(t *testing.T) {
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger := NewLogger(types.Config{
+		Provider:    "generic",
+		Token:       server.URL,
+		ServiceName: "billing",
+		Environment: "prod",
+		Channel:     "payments",
+		LocalSink:   NewWriterSink(io.Discard),
+	}).With("order_id", "ord-1")
+	if err := logger.Send(types.CRITICAL, "charge failed", nil, "stack"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	for key, want := range map[string]interface{}{
+		"service":     "billing",
+		"environment": "prod",
+		"level":       "CRITICAL",
+		"severity":    "critical",
+		"message":     "charge failed",
+		"channel":     "payments",
+	} {
+		if payload[key] != want {
+			t.Errorf("Expected %s=%v, got %v", key, want, payload[key])
+		}
+	}
+	if fields, _ := payload["fields"].(map[string]interface{}); fields["order_id"] != "ord-1" {
+		t.Errorf("Expected order_id field, got %v", payload["fields"])
+	}
+	if payload["trace"] != "stack" {
+		t.Errorf("Expected trace, got %v", payload["trace"])
+	}
+}
+
+func TestLoggerDeliverAlert(t *testing.T) {
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := NewLogger(types.Config{
+		Provider:       "generic",
+		Token:          server.URL,
+		Channel:        "ops",
+		MinRemoteLevel: types.WARN,
+		LocalSink:      NewWriterSink(&buf),
+	}).With("host", "web-1", "region", "eu")
+
+	ts := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	alert := &types.Alert{
+		Level:       types.ERROR,
+		Title:       "Checkout",
+		Message:     "charge failed",
+		Fields:      map[string]interface{}{"region": "us"},
+		Attachments: []types.Attachment{{URL: "https://example.com/log.txt"}},
+		DedupKey:    "checkout-charge",
+		Labels:      map[string]string{"team": "payments"},
+		Timestamp:   ts,
+	}
+	result, err := logger.Deliver(context.Background(), alert, "")
+	if err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	if result == nil || result.Provider != "generic" || result.Channel != "ops" || result.Ref != nil {
+		t.Errorf("Unexpected delivery result %+v", result)
+	}
+	if len(alert.Fields) != 1 {
+		t.Errorf("Expected Deliver to leave the alert unchanged, got fields %v", alert.Fields)
+	}
+
+	for key, want := range map[string]interface{}{
+		"title":     "Checkout",
+		"dedup_key": "checkout-charge",
+		"timestamp": "2026-10-18T09:00:00Z",
+	} {
+		if payload[key] != want {
+			t.Errorf("Expected %s=%v, got %v", key, want, payload[key])
+		}
+	}
+	fields, _ := payload["fields"].(map[string]interface{})
+	if fields["host"] != "web-1" || fields["region"] != "us" {
+		t.Errorf("Expected logger fields merged under alert fields, got %v", fields)
+	}
+	if labels, _ := payload["labels"].(map[string]interface{}); labels["team"] != "payments" {
+		t.Errorf("Expected labels, got %v", payload["labels"])
+	}
+	if attachments, _ := payload["attachments"].([]interface{}); len(attachments) != 1 {
+		t.Errorf("Expected 1 attachment, got %v", payload["attachments"])
+	}
+	if !strings.Contains(buf.String(), `"time":"2026-10-18T09:00:00Z"`) {
+		t.Errorf("Expected local record to use the alert timestamp, got %s", buf.String())
+	}
+
+	payload = nil
+	result, err = logger.Deliver(context.Background(), &types.Alert{Level: types.INFO, Message: "cache warmed"}, "")
+	if err != nil || result != nil || payload != nil {
+		t.Errorf("Expected INFO alert to be logged locally only, got result %+v, err %v, payload %v", result, err, payload)
+	}
+}
+
+func TestTraceDoesNotMutateAttachment(t *testing.T) {
+	var payload struct {
+		Attachments []map[string]interface{} `json:"attachments"`
+		Trace       string                   `json:"trace"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, LocalSink: NewWriterSink(io.Discard)})
+	attachment := &types.Attachment{FileName: "request.json", Content: `{"id":1}`}
+	if err := logger.Send(types.ERROR, "bad request", attachment, "stack trace here"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if attachment.Content != `{"id":1}` || attachment.FileName != "request.json" {
+		t.Errorf("Expected the caller's attachment to be unchanged, got %+v", attachment)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0]["content"] != `{"id":1}` {
+		t.Errorf("Expected the attachment to be delivered as is, got %v", payload.Attachments)
+	}
+	if payload.Attachments[0]["content_type"] != "application/json" {
+		t.Errorf("Expected content type from the file name, got %v", payload.Attachments[0]["content_type"])
+	}
+	if payload.Trace != "stack trace here" {
+		t.Errorf("Expected trace delivered separately, got %q", payload.Trace)
+	}
+}
+
+func TestLarkUploadsFileAttachments(t *testing.T) {
+	var mu sync.Mutex
+	var uploads []string
+	var fileMessages []string
+	var card string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/open-apis/im/v1/files":
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				t.Errorf("Expected multipart file upload: %v", err)
+				return
+			}
+			data, _ := io.ReadAll(file)
+			uploads = append(uploads, r.FormValue("file_type")+":"+header.Filename+":"+string(data))
+			w.Write([]byte(`{"code":0,"msg":"success","data":{"file_key":"file_v2_1"}}`))
+		case r.URL.Path == "/open-apis/im/v1/messages/om_1/reply":
+			var body struct {
+				MsgType string `json:"msg_type"`
+				Content string `json:"content"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			fileMessages = append(fileMessages, body.MsgType+":"+body.Content)
+			w.Write([]byte(`{"code":0,"msg":"success","data":{"message_id":"om_2"}}`))
+		default:
+			var body struct {
+				Content string `json:"content"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			card = body.Content
+			w.Write([]byte(`{"code":0,"msg":"success","data":{"message_id":"om_1"}}`))
+		}
+	}))
+	defer server.Close()
+
+	logger := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		Token:      "tenant-token",
+		Channel:    "chat_id:oc_alerts",
+		LarkToken:  types.LarkTokenConfig{Domain: server.URL},
+		LocalSink:  NewWriterSink(io.Discard),
+	})
+	result, err := logger.Deliver(context.Background(), &types.Alert{
+		Level:   types.ERROR,
+		Message: "report failed",
+		Attachments: []types.Attachment{
+			{FileName: "report.pdf", Data: []byte("%PDF-1.4")},
+			{FileName: "dump.bin", Reader: strings.NewReader("raw bytes")},
+			{FileName: "notes.txt", Content: "inline notes"},
+		},
+		Trace: "stack trace here",
+	}, "")
+	if err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	if result.Ref == nil || result.Ref.MessageID != "om_1" {
+		t.Errorf("Expected reference to the alert message, got %+v", result.Ref)
+	}
+
+	wantUploads := []string{"pdf:report.pdf:%PDF-1.4", "stream:dump.bin:raw bytes"}
+	if strings.Join(uploads, "|") != strings.Join(wantUploads, "|") {
+		t.Errorf("Expected uploads %q, got %q", wantUploads, uploads)
+	}
+	if len(fileMessages) != 2 || !strings.HasPrefix(fileMessages[0], `file:{"file_key":"file_v2_1"}`) {
+		t.Errorf("Expected 2 file messages in the alert thread, got %q", fileMessages)
+	}
+	for _, want := range []string{"inline notes", "trace.log", "stack trace here"} {
+		if !strings.Contains(card, want) {
+			t.Errorf("Expected card to contain %q, got %s", want, card)
+		}
+	}
+	if strings.Contains(card, "raw bytes") {
+		t.Errorf("Expected uploaded files to stay out of the card, got %s", card)
+	}
+}
+
+// newCaptureGeneric serves the generic provider endpoint and records each alert payload
+func newCaptureGeneric(t *testing.T) (*httptest.Server, func() []map[string]interface{}) {
+	var mu sync.Mutex
+	var payloads []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	return server, func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]interface{}(nil), payloads...)
+	}
+}
+
+func TestSendErrorCapturesChainAndStack(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, LocalSink: NewWriterSink(io.Discard)})
+
+	_, statErr := os.Stat("/does/not/exist")
+	err := fmt.Errorf("load config: %w", errors.Join(statErr, errors.New("fallback missing")))
+	if sendErr := logger.SendError(context.Background(), err, "startup failed"); sendErr != nil {
+		t.Fatalf("SendError failed: %v", sendErr)
+	}
+	if err := logger.SendError(context.Background(), nil, "ignored"); err != nil {
+		t.Fatalf("Expected nil error to be ignored, got %v", err)
+	}
+
+	got := payloads()
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(got))
+	}
+	if got[0]["level"] != "ERROR" || !strings.HasPrefix(got[0]["message"].(string), "startup failed: load config:") {
+		t.Errorf("Unexpected alert %v", got[0])
+	}
+	trace := got[0]["trace"].(string)
+	for _, want := range []string{
+		"*fmt.wrapError: load config",
+		"\n  *errors.joinError: ",
+		"\n    *fs.PathError: stat /does/not/exist",
+		"\n      syscall.Errno: ",
+		"\n    *errors.errorString: fallback missing",
+		"goroutine ",
+		"TestSendErrorCapturesChainAndStack()",
+	} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("Expected trace to contain %q, got:\n%s", want, trace)
+		}
+	}
+	if strings.Contains(trace, "(*Logger).SendError") || strings.Contains(trace, "runtime.") {
+		t.Errorf("Expected commonlog and runtime frames to be trimmed, got:\n%s", trace)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:          "generic",
+		Token:             server.URL,
+		DumpAllGoroutines: true,
+		LocalSink:         NewWriterSink(io.Discard),
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer logger.Recover()
+		panic(fmt.Errorf("nil map: %w", errors.New("assignment")))
+	}()
+	<-done
+
+	got := payloads()
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(got))
+	}
+	if got[0]["level"] != "FATAL" || got[0]["message"] != "panic: nil map: assignment" {
+		t.Errorf("Unexpected alert %v", got[0])
+	}
+	trace := got[0]["trace"].(string)
+	for _, want := range []string{"*errors.errorString: assignment", "TestRecover.func", "--- All goroutines ---"} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("Expected trace to contain %q, got:\n%s", want, trace)
+		}
+	}
+}
+
+func TestHTTPMiddlewareRecoversPanics(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, LocalSink: NewWriterSink(io.Discard)})
+
+	handler := HTTPMiddleware(logger, &HTTPMiddlewareOptions{
+		Route:          func(r *http.Request) string { return "/orders/{id}" },
+		IncludeHeaders: true,
+		RedactHeaders:  []string{"X-Session"},
+		RedactQuery:    []string{"session_id"},
+		IncludeBody:    true,
+		RedactBody:     []*regexp.Regexp{regexp.MustCompile(`"card":"[^"]*"`)},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		var m map[string]int
+		m["boom"]++
+	}))
+
+	req := httptest.NewRequest("POST", "/orders/42?access_token=s3cr3t&page=2&Session_ID=abc", strings.NewReader(`{"card":"4111","qty":1}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Session", "s3cret")
+	req.Header.Set("X-Request-Id", "req-7")
+	req.RemoteAddr = "10.0.0.9:5123"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 after panic, got %d", rr.Code)
+	}
+	logger.Close() // delivers the queued alerts
+	got := payloads()
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(got))
+	}
+	alert := got[0]
+	if alert["level"] != "ERROR" || !strings.HasPrefix(alert["message"].(string), "panic serving POST /orders/42: assignment to entry in nil map") {
+		t.Errorf("Unexpected alert %v", alert)
+	}
+	fields := alert["fields"].(map[string]interface{})
+	for key, want := range map[string]interface{}{
+		"method": "POST", "path": "/orders/42", "route": "/orders/{id}", "status": float64(500),
+		"client_ip": "10.0.0.9", "request_id": "req-7",
+	} {
+		if fields[key] != want {
+			t.Errorf("Expected field %s=%v, got %v", key, want, fields[key])
+		}
+	}
+	if _, ok := fields["latency"]; !ok {
+		t.Errorf("Expected latency field, got %v", fields)
+	}
+	if !strings.Contains(alert["trace"].(string), "TestHTTPMiddlewareRecoversPanics.func") {
+		t.Errorf("Expected trace with the handler frame, got:\n%s", alert["trace"])
+	}
+	dump := alert["attachments"].([]interface{})[0].(map[string]interface{})["content"].(string)
+	for _, want := range []string{"POST /orders/42?access_token=[REDACTED]&page=2&Session_ID=[REDACTED] HTTP/1.1", "Authorization: [REDACTED]", "X-Session: [REDACTED]", `{[REDACTED],"qty":1}`} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Expected request dump to contain %q, got:\n%s", want, dump)
+		}
+	}
+	if strings.Contains(dump, "secret") || strings.Contains(dump, "s3cr3t") || strings.Contains(dump, "4111") {
+		t.Errorf("Expected secrets to be redacted, got:\n%s", dump)
+	}
+}
+
+func TestHTTPMiddlewareStatusThreshold(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, LocalSink: NewWriterSink(io.Discard)})
+
+	handler := HTTPMiddleware(logger, &HTTPMiddlewareOptions{StatusThreshold: 500, TrustProxyHeaders: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/missing":
+				http.NotFound(w, r)
+			case "/down":
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				w.Write([]byte("ok"))
+			}
+		}))
+	for _, path := range []string{"/ok", "/missing", "/down"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	logger.Close() // delivers the queued alerts
+	got := payloads()
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 alert for the 503, got %d", len(got))
+	}
+	if got[0]["message"] != "GET /down returned 503" {
+		t.Errorf("Unexpected message %v", got[0]["message"])
+	}
+	if fields := got[0]["fields"].(map[string]interface{}); fields["client_ip"] != "203.0.113.5" {
+		t.Errorf("Expected forwarded client IP, got %v", fields["client_ip"])
+	}
+	if _, ok := got[0]["trace"]; ok {
+		t.Errorf("Expected no trace for a status alert, got %v", got[0]["trace"])
+	}
+}
+
+func TestHTTPMiddlewareErrorThreshold(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, LocalSink: NewWriterSink(io.Discard)})
+
+	handler := HTTPMiddleware(logger, &HTTPMiddlewareOptions{StatusThreshold: 500, ErrorThreshold: 3, ErrorWindow: time.Minute})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/upstream", nil))
+	}
+	if got := payloads(); len(got) != 0 {
+		t.Fatalf("Expected no alert below the threshold, got %d", len(got))
+	}
+	for i := 0; i < 4; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/upstream", nil))
+	}
+
+	logger.Close() // delivers the queued alerts
+	got := payloads()
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 alert per window, got %d", len(got))
+	}
+	if want := "GET /upstream returned 502 (3 responses at or above 500 in the last 1m)"; got[0]["message"] != want {
+		t.Errorf("Expected message %q, got %v", want, got[0]["message"])
+	}
+}
+
+func TestHTTPMiddlewareDoesNotWaitForDelivery(t *testing.T) {
+	release := make(chan struct{})
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+	var buf bytes.Buffer
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, AsyncQueueSize: 1, LocalSink: NewWriterSink(&buf)})
+
+	handler := HTTPMiddleware(logger, &HTTPMiddlewareOptions{StatusThreshold: 500})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected responses not to wait for alert delivery, took %v", elapsed)
+	}
+	close(release)
+	logger.Close()
+
+	// At most one alert is in flight and one queued; the rest are dropped while the queue is full
+	if n := atomic.LoadInt32(&received); n < 1 || n > 2 {
+		t.Errorf("Expected 1 or 2 delivered alerts, got %d", n)
+	}
+	if !strings.Contains(buf.String(), ErrQueueFull.Error()) {
+		t.Errorf("Expected dropped alerts in the local sink, got %s", buf.String())
+	}
+}
+
+func TestLoggerStartsAsyncWorkerLazily(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		NewLogger(types.Config{Provider: "generic", Token: "http://127.0.0.1:1"})
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("Expected Loggers that never queue alerts to hold no goroutines, went from %d to %d", before, after)
+	}
+
+	// Closing a Logger that never started its worker returns at once
+	logger := NewLogger(types.Config{Provider: "generic", Token: "http://127.0.0.1:1"})
+	if err := logger.Close(); err != nil {
+		t.Errorf("Expected Close to succeed, got %v", err)
+	}
+	if logger.DeliverAsync(context.Background(), &types.Alert{Level: types.ERROR, Message: "late"}, "") {
+		t.Error("Expected DeliverAsync to refuse alerts after Close")
+	}
+}
+
+func TestHTTPMiddlewarePassesHijacker(t *testing.T) {
+	logger := NewLogger(types.Config{Provider: "generic", Token: "http://127.0.0.1:1", LocalSink: NewWriterSink(io.Discard)})
+	handler := HTTPMiddleware(logger, &HTTPMiddlewareOptions{StatusThreshold: 500})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hijacker, ok := w.(http.Hijacker)
+			if !ok {
+				t.Error("Expected the middleware's writer to implement http.Hijacker")
+				return
+			}
+			conn, rw, err := hijacker.Hijack()
+			if err != nil {
+				t.Errorf("Hijack failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			rw.Flush()
+		}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Expected 101, got %d", resp.StatusCode)
+	}
+
+	var plain http.ResponseWriter
+	HTTPMiddleware(logger, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plain = w
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if _, ok := plain.(http.Hijacker); ok {
+		t.Error("Expected no http.Hijacker when the underlying writer lacks it")
+	}
+}
+
+func TestRedisIncrAlwaysSetsTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := cache.NewRedis(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	ctx := context.Background()
+
+	for want := int64(1); want <= 2; want++ {
+		n, err := store.Incr(ctx, "window", time.Minute)
+		if err != nil || n != want {
+			t.Fatalf("Expected counter %d, got %d (%v)", want, n, err)
+		}
+		if ttl := server.TTL("window"); ttl <= 0 || ttl > time.Minute {
+			t.Errorf("Expected the counter to expire within a minute, got TTL %v", ttl)
+		}
+	}
+
+	// A counter left without an expiry, e.g. by a crash between INCR and EXPIRE, is given one
+	server.Set("stuck", "5")
+	if n, err := store.Incr(ctx, "stuck", time.Minute); err != nil || n != 6 {
+		t.Fatalf("Expected counter 6, got %d (%v)", n, err)
+	}
+	if ttl := server.TTL("stuck"); ttl <= 0 {
+		t.Errorf("Expected the stuck counter to be given a TTL, got %v", ttl)
+	}
+}
+
+func TestDedupSuppressesRepeatsAndSendsDigest(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:    "generic",
+		Token:       server.URL,
+		ServiceName: "cron",
+		DedupWindow: 200 * time.Millisecond,
+		LocalSink:   NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := logger.Send(types.ERROR, fmt.Sprintf("job %d failed for order 7f3a9c21e0b4", 1000+i), nil, ""); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	logger.Send(types.ERROR, "a different failure", nil, "")
+	if got := payloads(); len(got) != 2 {
+		t.Fatalf("Expected the first occurrence and the different alert, got %d", len(got))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(payloads()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := payloads()
+	if len(got) != 3 {
+		t.Fatalf("Expected a digest after the window, got %d alerts", len(got))
+	}
+	want := "job 1000 failed for order 7f3a9c21e0b4\n\nThis occurred 4 more times in the last 200ms"
+	if got[2]["message"] != want {
+		t.Errorf("Expected digest %q, got %q", want, got[2]["message"])
+	}
+
+	// A new window opens once the previous one has closed
+	logger.Send(types.ERROR, "job 2000 failed for order 7f3a9c21e0b4", nil, "")
+	if got := payloads(); len(got) != 4 {
+		t.Errorf("Expected the next occurrence to be sent, got %d alerts", len(got))
+	}
+}
+
+func TestDedupSharedStoreAndCloseFlushesDigest(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	store := cache.NewMemory()
+	newReplica := func() *Logger {
+		return NewLogger(types.Config{
+			Provider:         "generic",
+			Token:            server.URL,
+			DedupWindow:      time.Hour,
+			DedupStore:       store,
+			DedupFingerprint: func(a *types.Alert) string { return "disk-full" },
+			LocalSink:        NewWriterSink(io.Discard),
+		})
+	}
+	first, second := newReplica(), newReplica()
+
+	first.Send(types.CRITICAL, "disk full on web-1", nil, "")
+	second.Send(types.CRITICAL, "disk full on web-2", nil, "")
+	second.Send(types.CRITICAL, "disk full on web-3", nil, "")
+	second.Close()
+	if got := payloads(); len(got) != 1 {
+		t.Fatalf("Expected repeats on the other replica to be suppressed, got %d alerts", len(got))
+	}
+
+	first.Close()
+	got := payloads()
+	if len(got) != 2 || !strings.HasSuffix(got[1]["message"].(string), "This occurred 2 more times in the last 1h") {
+		t.Errorf("Expected Close to send the digest, got %v", got)
+	}
+}
+
+func TestDedupWindowsPerChannel(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:    "generic",
+		Token:       server.URL,
+		DedupWindow: time.Hour,
+		LocalSink:   NewWriterSink(io.Discard),
+	})
+
+	for _, channel := range []string{"payments", "payments", "oncall", "oncall", "oncall"} {
+		logger.SendToChannel(types.ERROR, "card processor timeout", nil, "", channel)
+	}
+	logger.Close()
+
+	digests := map[string]string{}
+	for _, payload := range payloads() {
+		if message := payload["message"].(string); strings.Contains(message, "This occurred") {
+			digests[payload["channel"].(string)] = message
+		}
+	}
+	if len(payloads()) != 4 || !strings.HasSuffix(digests["payments"], "1 more time in the last 1h") ||
+		!strings.HasSuffix(digests["oncall"], "2 more times in the last 1h") {
+		t.Errorf("Expected an alert and a digest per channel, got %v", payloads())
+	}
+}
+
+func TestMessageTemplate(t *testing.T) {
+	got := MessageTemplate("user 42 request 9b2f6d1e-3c4a-4e5f-8a7b-0c1d2e3f4a5b hash deadbeef12 took 35ms")
+	want := "user <n> request <uuid> hash <hex> took <n>ms"
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	newLogger := func(url, policy string, limit types.RateLimit) *Logger {
+		return NewLogger(types.Config{
+			Provider:        "generic",
+			Token:           url,
+			Channel:         "ops",
+			RateLimits:      map[string]types.RateLimit{"generic": limit},
+			RateLimitPolicy: policy,
+			LocalSink:       NewWriterSink(io.Discard),
+		})
+	}
+
+	t.Run("queue", func(t *testing.T) {
+		server, payloads := newCaptureGeneric(t)
+		defer server.Close()
+		logger := newLogger(server.URL, "", types.RateLimit{Rate: 50, Burst: 1})
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := logger.Send(types.ERROR, "queued", nil, ""); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		if len(payloads()) != 3 || time.Since(start) < 35*time.Millisecond {
+			t.Errorf("Expected 3 alerts spaced by the limit, got %d in %v", len(payloads()), time.Since(start))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		if _, err := logger.Deliver(ctx, &types.Alert{Level: types.ERROR, Message: "late"}, ""); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the context deadline to bound the wait, got %v", err)
+		}
+	})
+
+	t.Run("queue is bounded by RateLimitMaxWait", func(t *testing.T) {
+		server, payloads := newCaptureGeneric(t)
+		defer server.Close()
+		logger := newLogger(server.URL, "", types.RateLimit{Rate: 1, Burst: 1})
+		logger.config.RateLimitMaxWait = 100 * time.Millisecond
+		for i := 0; i < 5; i++ {
+			start := time.Now()
+			if err := logger.Send(types.ERROR, fmt.Sprintf("flood %d", i), nil, ""); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Fatalf("Expected Send to return within the max wait, took %v", elapsed)
+			}
+		}
+		logger.Close()
+
+		got := payloads()
+		if len(got) != 2 {
+			t.Fatalf("Expected the first alert and a summary, got %d", len(got))
+		}
+		if msg := got[1]["message"].(string); !strings.HasPrefix(msg, "4 alerts were rate limited:") {
+			t.Errorf("Expected a summary of the 4 limited alerts, got %q", msg)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		server, payloads := newCaptureGeneric(t)
+		defer server.Close()
+		var buf bytes.Buffer
+		logger := newLogger(server.URL, types.RateLimitDrop, types.RateLimit{Rate: 1, Burst: 2})
+		logger.config.LocalSink = NewWriterSink(&buf)
+		var dropped int
+		for i := 0; i < 4; i++ {
+			if err := logger.Send(types.ERROR, "burst", nil, ""); errors.Is(err, ErrRateLimited) {
+				dropped++
+			}
+		}
+		if len(payloads()) != 2 || dropped != 2 {
+			t.Errorf("Expected 2 alerts sent and 2 dropped, got %d and %d", len(payloads()), dropped)
+		}
+		if !strings.Contains(buf.String(), "rate limited") {
+			t.Errorf("Expected dropped alerts in the local sink, got %s", buf.String())
+		}
+	})
+
+	t.Run("summarize", func(t *testing.T) {
+		server, payloads := newCaptureGeneric(t)
+		defer server.Close()
+		logger := newLogger(server.URL, types.RateLimitSummarize, types.RateLimit{Rate: 20, Burst: 1})
+		logger.Send(types.ERROR, "first", nil, "")
+		logger.Send(types.WARN, "second", nil, "")
+		logger.Send(types.CRITICAL, "third\nwith details", nil, "")
+		logger.Send(types.ERROR, "fourth", nil, "")
+
+		deadline := time.Now().Add(2 * time.Second)
+		for len(payloads()) < 2 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		got := payloads()
+		if len(got) != 2 {
+			t.Fatalf("Expected the first alert and a summary, got %d", len(got))
+		}
+		want := "3 alerts were rate limited:\n• second\n• third\n• fourth"
+		if got[1]["message"] != want || got[1]["level"] != "CRITICAL" || got[1]["channel"] != "ops" {
+			t.Errorf("Expected CRITICAL summary %q to ops, got %v", want, got[1])
+		}
+
+		// The summary took the channel's token
+		logger.Send(types.ERROR, "fifth", nil, "")
+		if got := payloads(); len(got) != 2 {
+			t.Errorf("Expected the alert after the summary to be limited, got %d alerts", len(got))
+		}
+	})
+
+	t.Run("dedup digests", func(t *testing.T) {
+		server, payloads := newCaptureGeneric(t)
+		defer server.Close()
+		logger := NewLogger(types.Config{
+			Provider:        "generic",
+			Token:           server.URL,
+			DedupWindow:     50 * time.Millisecond,
+			RateLimits:      map[string]types.RateLimit{"generic": {Rate: 0.001, Burst: 2}},
+			RateLimitPolicy: types.RateLimitDrop,
+			LocalSink:       NewWriterSink(io.Discard),
+		})
+		defer logger.Close()
+		for i := 0; i < 3; i++ {
+			logger.Send(types.ERROR, fmt.Sprintf("fingerprint %c", 'a'+i), nil, "")
+			logger.Send(types.ERROR, fmt.Sprintf("fingerprint %c", 'a'+i), nil, "")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if got := payloads(); len(got) != 2 {
+			t.Errorf("Expected digests to be held to the limit of 2, got %d alerts", len(got))
+		}
+	})
+}
+
+func TestBatchDigestGroupsByFingerprint(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:       "generic",
+		Token:          server.URL,
+		MinRemoteLevel: types.INFO,
+		BatchMaxLevel:  types.WARN,
+		BatchInterval:  time.Hour,
+		BatchSize:      4,
+		LocalSink:      NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	logger.Send(types.WARN, "disk usage 91% on web-1", nil, "")
+	logger.Send(types.INFO, "cache miss ratio high", nil, "")
+	logger.Send(types.ERROR, "payment failed", nil, "")
+	logger.Send(types.WARN, "disk usage 95% on web-2", nil, "")
+	if got := payloads(); len(got) != 1 || got[0]["message"] != "payment failed" {
+		t.Fatalf("Expected only the ERROR alert to bypass the batch, got %v", got)
+	}
+
+	logger.Send(types.WARN, "disk usage 97% on web-3", nil, "")
+	got := payloads()
+	if len(got) != 2 {
+		t.Fatalf("Expected a full batch to send its digest, got %d alerts", len(got))
+	}
+	message := got[1]["message"].(string)
+	for _, want := range []string{"4 alerts in the last", "• 3× [WARN] disk usage 91% on web-1", "• 1× [INFO] cache miss ratio high"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("Expected digest to contain %q, got %q", want, message)
+		}
+	}
+	if got[1]["level"] != "WARN" {
+		t.Errorf("Expected digest at the highest batched level, got %v", got[1]["level"])
+	}
+}
+
+func TestBatchCloseSendsOneCardPerChannel(t *testing.T) {
+	server, contents := newCaptureLark(t)
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:      "lark",
+		SendMethod:    types.MethodWebClient,
+		Token:         "tenant-token",
+		LarkToken:     types.LarkTokenConfig{Domain: server.URL},
+		BatchMaxLevel: types.WARN,
+		BatchInterval: time.Hour,
+		RateLimits:    map[string]types.RateLimit{"lark": {}},
+		LocalSink:     NewWriterSink(io.Discard),
+	})
+
+	for i := 0; i < 3; i++ {
+		logger.SendToChannel(types.WARN, fmt.Sprintf("queue lag %ds", 10+i), nil, "", "chat_id:oc_a")
+	}
+	logger.SendToChannel(types.WARN, "replica behind", nil, "", "chat_id:oc_b")
+	if len(*contents) != 0 {
+		t.Fatalf("Expected alerts to be buffered, got %d messages", len(*contents))
+	}
+
+	logger.Close()
+	if len(*contents) != 2 {
+		t.Fatalf("Expected Close to send one card per channel, got %d", len(*contents))
+	}
+	all := strings.Join(*contents, "\n")
+	for _, want := range []string{"3× [WARN] queue lag 10s", "1× [WARN] replica behind"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Expected cards to contain %q, got %s", want, all)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	var hits int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var changes []string
+	logger := NewLogger(types.Config{
+		Provider: "generic",
+		Token:    server.URL,
+		CircuitBreaker: types.CircuitBreakerConfig{
+			FailureThreshold: 2,
+			OpenTimeout:      50 * time.Millisecond,
+			OnStateChange: func(endpoint string, from, to types.CircuitState) {
+				mu.Lock()
+				changes = append(changes, from.String()+"->"+to.String())
+				mu.Unlock()
+			},
+		},
+		LocalSink: NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := logger.Send(types.ERROR, "outage", nil, ""); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected delivery failure %d, got %v", i+1, err)
+		}
+	}
+	err := logger.Send(types.ERROR, "outage", nil, "")
+	var open *CircuitOpenError
+	if !errors.As(err, &open) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected the open circuit to fail fast, got %v", err)
+	}
+	if open.Endpoint != "generic:"+strings.TrimPrefix(server.URL, "http://") {
+		t.Errorf("Unexpected endpoint %q", open.Endpoint)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("Expected 2 requests while the circuit was open, got %d", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	healthy.Store(true)
+	if err := logger.Send(types.ERROR, "recovered", nil, ""); err != nil {
+		t.Fatalf("Expected the trial delivery to succeed, got %v", err)
+	}
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("Expected state changes %v, got %v", want, changes)
+	}
+}
+
+// slackAPITransport answers Slack Web API calls, failing chat.postMessage to #gone with channel_not_found
+type slackAPITransport struct {
+	requests int32
+}
+
+func (s *slackAPITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&s.requests, 1)
+	var payload struct {
+		Channel string `json:"channel"`
+	}
+	json.NewDecoder(req.Body).Decode(&payload)
+	body := `{"ok":true,"channel":"C1","ts":"1.0"}`
+	if payload.Channel == "#gone" {
+		body = `{"ok":false,"error":"channel_not_found"}`
+	}
+	return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"application/json"}},
+		Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+func TestCircuitBreakerIgnoresPermanentErrors(t *testing.T) {
+	transport := &slackAPITransport{}
+	logger := NewLogger(types.Config{
+		Provider:       "slack",
+		SendMethod:     types.MethodWebClient,
+		Token:          "xoxb-test",
+		HTTP:           types.HTTPConfig{Transport: transport},
+		RateLimits:     map[string]types.RateLimit{"slack": {}},
+		CircuitBreaker: types.CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour},
+		LocalSink:      NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	for i := 0; i < 3; i++ {
+		err := logger.SendToChannel(types.ERROR, "to a deleted channel", nil, "", "#gone")
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected channel_not_found from Slack, got %v", err)
+		}
+	}
+	if err := logger.SendToChannel(types.ERROR, "to a live channel", nil, "", "#ops"); err != nil {
+		t.Fatalf("Expected other channels to be unaffected, got %v", err)
+	}
+	if n := atomic.LoadInt32(&transport.requests); n != 4 {
+		t.Errorf("Expected every delivery to reach Slack, got %d requests", n)
+	}
+
+	// Lark throttling answers 429 with an error envelope, which is still transient
+	throttled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"code":99991400,"msg":"request trigger frequency limit"}`))
+	}))
+	defer throttled.Close()
+	lark := NewLogger(types.Config{
+		Provider:       "lark",
+		SendMethod:     types.MethodWebClient,
+		Token:          "tenant-token",
+		Channel:        "oc_ops",
+		LarkToken:      types.LarkTokenConfig{Domain: throttled.URL},
+		CircuitBreaker: types.CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour},
+		LocalSink:      NewWriterSink(io.Discard),
+	})
+	defer lark.Close()
+	if err := lark.Send(types.ERROR, "throttled", nil, ""); !types.IsTransient(err) {
+		t.Fatalf("Expected a transient error from a throttled Lark endpoint, got %v", err)
+	}
+	if err := lark.Send(types.ERROR, "throttled again", nil, ""); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected the circuit to open after Lark throttling, got %v", err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	untrusted.Config.ErrorLog = log.New(io.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	get := func(url string) error {
+		client := &http.Client{Timeout: 50 * time.Millisecond}
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	for name, tc := range map[string]struct {
+		err  error
+		want bool
+	}{
+		"malformed scheme":   {get("htp://example.com"), false},
+		"untrusted CA":       {get(untrusted.URL), false},
+		"connection refused": {get(closed.URL), true},
+		"timeout":            {get(slow.URL), true},
+		"503":                {&types.HTTPStatusError{Source: "test", StatusCode: 503}, true},
+		"429":                {&types.HTTPStatusError{Source: "test", StatusCode: 429}, true},
+		"400":                {&types.HTTPStatusError{Source: "test", StatusCode: 400}, false},
+	} {
+		if tc.err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		if got := types.IsTransient(tc.err); got != tc.want {
+			t.Errorf("%s: expected IsTransient %v, got %v for %v", name, tc.want, got, tc.err)
+		}
+	}
+}
+
+func TestCircuitBreakerFailover(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	failover, payloads := newCaptureGeneric(t)
+	defer failover.Close()
+
+	logger := NewLogger(types.Config{
+		Provider:    "generic",
+		Token:       primary.URL,
+		ServiceName: "billing",
+		CircuitBreaker: types.CircuitBreakerConfig{
+			FailureThreshold: 1,
+			OpenTimeout:      time.Hour,
+			Failover:         &types.Config{Provider: "generic", Token: failover.URL, Channel: "backup"},
+		},
+		LocalSink: NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	if err := logger.Send(types.ERROR, "first", nil, ""); err == nil {
+		t.Fatal("Expected the primary delivery to fail")
+	}
+	if err := logger.Send(types.ERROR, "second", nil, ""); err != nil {
+		t.Fatalf("Expected the failover delivery to succeed, got %v", err)
+	}
+	got := payloads()
+	if len(got) != 1 || got[0]["message"] != "second" || got[0]["channel"] != "backup" || got[0]["service"] != "billing" {
+		t.Errorf("Expected the alert at the failover, got %v", got)
+	}
+}
+
+func TestSpoolReplaysAfterRestart(t *testing.T) {
+	var healthy atomic.Bool
+	var mu sync.Mutex
+	var payloads []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	cfg := types.Config{
+		Provider:  "generic",
+		Token:     server.URL,
+		Spool:     types.SpoolConfig{Dir: dir, RetryInterval: time.Hour},
+		LocalSink: NewWriterSink(io.Discard),
+	}
+	logger := NewLogger(cfg)
+	logger.Send(types.ERROR, "first", nil, "")
+	logger.Send(types.CRITICAL, "second", &types.Attachment{FileName: "dump.txt", Reader: strings.NewReader("heap")}, "")
+	stats := logger.SpoolStats()
+	if stats.Depth != 2 || stats.Bytes == 0 || stats.Oldest.IsZero() {
+		t.Fatalf("Expected 2 spooled alerts, got %+v", stats)
+	}
+	logger.Close()
+
+	healthy.Store(true)
+	cfg.Spool.RetryInterval = 10 * time.Millisecond
+	logger = NewLogger(cfg)
+	defer logger.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for logger.SpoolStats().Depth > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := logger.SpoolStats(); stats.Depth != 0 || stats.Bytes != 0 || !stats.Oldest.IsZero() {
+		t.Fatalf("Expected the spool to drain, got %+v", stats)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(payloads) != 2 || payloads[0]["message"] != "first" || payloads[1]["message"] != "second" {
+		t.Fatalf("Expected spooled alerts replayed in order, got %v", payloads)
+	}
+	attachments, _ := payloads[1]["attachments"].([]interface{})
+	if len(attachments) != 1 || attachments[0].(map[string]interface{})["data"] != "aGVhcA==" {
+		t.Errorf("Expected the attachment content to survive the spool, got %v", payloads[1]["attachments"])
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log")); len(segments) != 0 {
+		t.Errorf("Expected replayed segments to be removed, got %v", segments)
+	}
+}
+
+func TestSpoolKeepsOnlyTransientFailures(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	var mu sync.Mutex
+	var delivered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		code := int(status.Load())
+		if code == http.StatusOK && payload["message"] == "rejected" {
+			code = http.StatusBadRequest
+		}
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		mu.Lock()
+		delivered = append(delivered, payload["message"].(string))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := types.Config{
+		Provider:  "generic",
+		Token:     server.URL,
+		Spool:     types.SpoolConfig{Dir: t.TempDir(), RetryInterval: time.Hour},
+		LocalSink: NewWriterSink(io.Discard),
+	}
+	logger := NewLogger(cfg)
+	logger.Send(types.ERROR, "rejected", nil, "")
+	logger.Send(types.ERROR, "queued", nil, "")
+	status.Store(http.StatusBadRequest)
+	logger.Send(types.ERROR, "malformed", nil, "")
+	if depth := logger.SpoolStats().Depth; depth != 2 {
+		t.Fatalf("Expected only the 2 alerts failing with 503 to be spooled, got %d", depth)
+	}
+	logger.Close()
+
+	// The alert now rejected with 400 is dropped instead of blocking the one behind it
+	status.Store(http.StatusOK)
+	cfg.Spool.RetryInterval = 10 * time.Millisecond
+	logger = NewLogger(cfg)
+	defer logger.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for logger.SpoolStats().Depth > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := logger.SpoolStats().Depth; depth != 0 {
+		t.Fatalf("Expected the spool to drain past the permanent failure, got depth %d", depth)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(delivered) != "[queued]" {
+		t.Errorf("Expected only the queued alert to be replayed, got %v", delivered)
+	}
+}
+
+func TestSpoolDropsPermanentTransportErrors(t *testing.T) {
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	untrusted.Config.ErrorLog = log.New(io.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+
+	for _, url := range []string{untrusted.URL, "htp://alerts.example.com"} {
+		var sink bytes.Buffer
+		logger := NewLogger(types.Config{
+			Provider:  "generic",
+			Token:     url,
+			Spool:     types.SpoolConfig{Dir: t.TempDir(), RetryInterval: time.Hour},
+			LocalSink: NewWriterSink(&sink),
+		})
+		if err := logger.Send(types.ERROR, "misconfigured", nil, ""); err == nil {
+			t.Errorf("%s: expected the delivery to fail", url)
+		}
+		if depth := logger.SpoolStats().Depth; depth != 0 {
+			t.Errorf("%s: expected a permanent transport error not to be spooled, got depth %d", url, depth)
+		}
+		logger.Close()
+	}
+}
+
+func TestSpoolKeepsThrottledLarkAlerts(t *testing.T) {
+	var throttled atomic.Bool
+	throttled.Store(true)
+	var sent int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if throttled.Load() {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":99991400,"msg":"request trigger frequency limit"}`))
+			return
+		}
+		atomic.AddInt32(&sent, 1)
+		w.Write([]byte(`{"code":0,"msg":"success","data":{"message_id":"om_1"}}`))
+	}))
+	defer server.Close()
+
+	logger := NewLogger(types.Config{
+		Provider:   "lark",
+		SendMethod: types.MethodWebClient,
+		Token:      "tenant-token",
+		Channel:    "oc_ops",
+		LarkToken:  types.LarkTokenConfig{Domain: server.URL},
+		Spool:      types.SpoolConfig{Dir: t.TempDir(), RetryInterval: 10 * time.Millisecond},
+		LocalSink:  NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+	logger.Send(types.ERROR, "throttled", nil, "")
+	if depth := logger.SpoolStats().Depth; depth != 1 {
+		t.Fatalf("Expected the throttled alert to be spooled, got depth %d", depth)
+	}
+
+	// Replays that are still throttled keep the alert spooled
+	time.Sleep(50 * time.Millisecond)
+	if depth := logger.SpoolStats().Depth; depth != 1 {
+		t.Fatalf("Expected the alert to stay spooled while throttled, got depth %d", depth)
+	}
+
+	throttled.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for logger.SpoolStats().Depth > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := logger.SpoolStats().Depth; depth != 0 {
+		t.Fatalf("Expected the spool to drain once throttling ends, got depth %d", depth)
+	}
+	if n := atomic.LoadInt32(&sent); n != 1 {
+		t.Errorf("Expected the alert to be delivered once, got %d", n)
+	}
+}
+
+func TestSpoolSizeCap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:  "generic",
+		Token:     server.URL,
+		Spool:     types.SpoolConfig{Dir: t.TempDir(), SegmentSize: 512, MaxSize: 1200, Sync: types.SpoolSyncNever, RetryInterval: time.Hour},
+		LocalSink: NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	for i := 0; i < 10; i++ {
+		logger.Send(types.ERROR, fmt.Sprintf("failure %d", i), nil, "")
+	}
+	stats := logger.SpoolStats()
+	if stats.Depth == 0 || stats.Depth == 10 || stats.Bytes > 1200 {
+		t.Errorf("Expected the spool to stop at MaxSize, got %+v", stats)
+	}
+}
+
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClientTransportAndUserAgent(t *testing.T) {
+	var userAgent atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent.Store(r.UserAgent())
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	logger := NewLogger(types.Config{
+		Provider:    "generic",
+		Token:       server.URL,
+		ServiceName: "billing",
+		Environment: "production",
+		HTTP:        types.HTTPConfig{Transport: transport},
+		LocalSink:   NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	if err := logger.Send(types.ERROR, "payment failed", nil, ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&transport.requests); n != 1 {
+		t.Errorf("Expected the request to use the configured transport, got %d round trips", n)
+	}
+	if got := userAgent.Load(); got != "commonlog-go (billing; production)" {
+		t.Errorf("Unexpected User-Agent %q", got)
+	}
+
+	if _, err := (types.HTTPConfig{Transport: transport, ProxyURL: "http://proxy:3128"}).NewClient(); err == nil {
+		t.Error("Expected proxy options to be rejected with a custom transport")
+	}
+}
+
+func TestHTTPClientProxyTimeoutAndCA(t *testing.T) {
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+	}))
+	defer proxy.Close()
+
+	client, err := (types.HTTPConfig{ProxyURL: proxy.URL}).NewClient()
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	resp, err := client.Get("http://alerts.internal/hook")
+	if err != nil {
+		t.Fatalf("Expected the request to go through the proxy, got %v", err)
+	}
+	resp.Body.Close()
+	if got := proxied.Load(); got != "http://alerts.internal/hook" {
+		t.Errorf("Expected the proxy to receive the request, got %v", got)
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	client, _ = (types.HTTPConfig{Timeout: 20 * time.Millisecond}).NewClient()
+	if _, err := client.Get(slow.URL); err == nil {
+		t.Error("Expected the request to time out")
+	}
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	client, _ = (types.HTTPConfig{}).NewClient()
+	if _, err := client.Get(tlsServer.URL); err == nil {
+		t.Error("Expected the untrusted certificate to be rejected")
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	client, err = (types.HTTPConfig{CAPEM: caPEM}).NewClient()
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	resp, err = client.Get(tlsServer.URL)
+	if err != nil {
+		t.Fatalf("Expected the custom CA to be trusted, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestInvalidHTTPOptionsFailDeliveries(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	cfg := types.Config{
+		Provider:  "generic",
+		Token:     server.URL,
+		HTTP:      types.HTTPConfig{CAFile: filepath.Join(t.TempDir(), "missing-ca.pem")},
+		LocalSink: NewWriterSink(io.Discard),
+	}
+	var cfgErr *types.ConfigError
+	if err := cfg.Validate(); !errors.As(err, &cfgErr) || len(cfgErr.Invalid) != 1 || !strings.HasPrefix(cfgErr.Invalid[0], "HTTP: ") {
+		t.Errorf("Expected Validate to report the CA file, got %v", err)
+	}
+
+	logger := NewLogger(cfg)
+	defer logger.Close()
+	if err := logger.Send(types.ERROR, "unpinned", nil, ""); err == nil || !strings.Contains(err.Error(), "invalid HTTP options") {
+		t.Errorf("Expected the send to fail with the HTTP config error, got %v", err)
+	}
+	if got := payloads(); len(got) != 0 {
+		t.Errorf("Expected no request with the default client, got %d", len(got))
+	}
+}
+
+func TestCircuitBreakerFailoverUsesItsOwnHTTPOptions(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	failover, payloads := newCaptureGeneric(t)
+	defer failover.Close()
+
+	main, backup := &countingTransport{}, &countingTransport{}
+	logger := NewLogger(types.Config{
+		Provider: "generic",
+		Token:    primary.URL,
+		HTTP:     types.HTTPConfig{Transport: main},
+		CircuitBreaker: types.CircuitBreakerConfig{
+			FailureThreshold: 1,
+			OpenTimeout:      time.Hour,
+			Failover: &types.Config{Provider: "generic", Token: failover.URL,
+				HTTP: types.HTTPConfig{Transport: backup}},
+		},
+		LocalSink: NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	logger.Send(types.ERROR, "first", nil, "")
+	if err := logger.Send(types.ERROR, "second", nil, ""); err != nil || len(payloads()) != 1 {
+		t.Fatalf("Expected the failover delivery to succeed, got %v", err)
+	}
+	if m, b := atomic.LoadInt32(&main.requests), atomic.LoadInt32(&backup.requests); m != 1 || b != 1 {
+		t.Errorf("Expected 1 request on each transport, got %d on the main and %d on the failover", m, b)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	for key, value := range map[string]string{
+		"ALERTS_PROVIDER":         "Lark",
+		"ALERTS_LARK_APP_ID":      "cli_a1",
+		"ALERTS_LARK_APP_SECRET":  "secret",
+		"ALERTS_LARK_DOMAIN":      "feishu",
+		"ALERTS_CHANNEL":          "alerts",
+		"ALERTS_CHANNEL_CRITICAL": "oncall",
+		"ALERTS_SERVICE_NAME":     "billing",
+		"ALERTS_ENVIRONMENT":      "production",
+		"ALERTS_MIN_REMOTE_LEVEL": "warning",
+		"ALERTS_REDIS_ADDRS":      "redis-0:6379, redis-1:6379",
+		"ALERTS_REDIS_DB":         "2",
+		"ALERTS_DEBUG":            "true",
+	} {
+		t.Setenv(key, value)
+	}
+
+	cfg, err := ConfigFromEnv("ALERTS_")
+	if err != nil {
+		t.Fatalf("ConfigFromEnv failed: %v", err)
+	}
+	if cfg.Provider != "lark" || cfg.SendMethod != types.MethodWebClient || cfg.LarkToken.AppID != "cli_a1" ||
+		cfg.LarkToken.Domain != types.LarkDomainFeishu || cfg.ServiceName != "billing" || cfg.MinRemoteLevel != types.WARN ||
+		!cfg.Debug || len(cfg.Redis.Addrs) != 2 || cfg.Redis.DB != 2 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	if cfg.ChannelResolver == nil || cfg.ChannelResolver.ResolveChannel(types.CRITICAL) != "oncall" ||
+		cfg.ChannelResolver.ResolveChannel(types.ERROR) != "alerts" {
+		t.Errorf("Expected per-level channels, got %+v", cfg.ChannelResolver)
+	}
+}
+
+func TestConfigFromEnvReportsEveryProblem(t *testing.T) {
+	t.Setenv("COMMONLOG_SEND_METHOD", "carrier-pigeon")
+	t.Setenv("COMMONLOG_DEBUG", "sometimes")
+	t.Setenv("COMMONLOG_CHANNEL_URGENT", "oncall")
+	t.Setenv("COMMONLOG_REDIS_HOST", "redis")
+
+	_, err := ConfigFromEnv("")
+	var cfgErr *types.ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Expected a *types.ConfigError, got %v", err)
+	}
+	if fmt.Sprint(cfgErr.Missing) != "[COMMONLOG_PROVIDER COMMONLOG_REDIS_PORT]" {
+		t.Errorf("Unexpected missing keys %v", cfgErr.Missing)
+	}
+	if len(cfgErr.Invalid) != 3 {
+		t.Errorf("Expected 3 invalid keys, got %v", cfgErr.Invalid)
+	}
+	for _, key := range []string{"COMMONLOG_SEND_METHOD", "COMMONLOG_DEBUG", "COMMONLOG_CHANNEL_URGENT"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected the error to mention %s, got %v", key, err)
+		}
+	}
+}
+
+func TestLoadConfigRoutesByLevel(t *testing.T) {
+	oncall, oncallPayloads := newCaptureGeneric(t)
+	defer oncall.Close()
+	team, teamPayloads := newCaptureGeneric(t)
+	defer team.Close()
+
+	secret := filepath.Join(t.TempDir(), "oncall-url")
+	os.WriteFile(secret, []byte(oncall.URL+"\n"), 0o600)
+	t.Setenv("TEAM_HOOK", team.URL)
+	t.Setenv("ALERTS_DEBUG", "false")
+
+	router, err := LoadConfig([]byte(`
+defaults:
+  provider: generic
+  service_name: billing
+  environment: ${DEPLOY_ENV:-staging}
+  debug: ${ALERTS_DEBUG}
+destinations:
+  oncall:
+    token: file://` + secret + `
+  team:
+    token: ${TEAM_HOOK}
+    min_remote_level: INFO
+routes:
+  - levels: [CRITICAL]
+    destinations: [oncall, team]
+  - min_level: INFO
+    destinations: [team]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	defer router.Close()
+
+	router.Send(types.WARN, "queue lag", nil, "")
+	router.Send(types.CRITICAL, "database down", nil, "")
+	if got := oncallPayloads(); len(got) != 1 || got[0]["message"] != "database down" || got[0]["environment"] != "staging" {
+		t.Errorf("Expected only the CRITICAL alert on call, got %v", got)
+	}
+	if got := teamPayloads(); len(got) != 2 || got[0]["service"] != "billing" {
+		t.Errorf("Expected both alerts for the team, got %v", got)
+	}
+	if router.Logger("team") == nil || router.Logger("unknown") != nil {
+		t.Error("Expected Logger to look up destinations by name")
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	_, err := LoadConfig([]byte(`{
+	"destinations": {
+		"slack": {"provider": "slack", "send_method": "webclient", "token": "https://hooks.slack.com/services/T/B/X"},
+		"lark": {"provider": "lark", "lark_app_id": "cli_a1", "channels": {"URGENT": "oncall"}}
+	},
+	"routes": [{"levels": ["ERROR"], "destinations": ["pagerduty"]}]
+}`))
+	var cfgErr *types.ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Expected a *types.ConfigError, got %v", err)
+	}
+	if fmt.Sprint(cfgErr.Missing) != "[destinations.lark.LarkToken.AppSecret]" {
+		t.Errorf("Unexpected missing keys %v", cfgErr.Missing)
+	}
+	for _, want := range []string{
+		"destinations.lark.channels",
+		"destinations.slack.Token: SendMethod webclient is configured with a webhook URL",
+		`routes[0].destinations: unknown destination "pagerduty"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to mention %q, got %v", want, err)
+		}
+	}
+
+	if _, err := LoadConfig([]byte("destinations:\n  a:\n    token: ${COMMONLOG_TEST_UNSET}\n")); err == nil ||
+		!strings.Contains(err.Error(), "${COMMONLOG_TEST_UNSET}") {
+		t.Errorf("Expected the unset variable to be reported, got %v", err)
+	}
+}
+
+func TestConfigFileDefaultsSendMethod(t *testing.T) {
+	file, err := ParseConfigFile([]byte(`
+destinations:
+  oncall:
+    provider: slack
+    token: xoxb-test
+`))
+	if err != nil {
+		t.Fatalf("ParseConfigFile failed: %v", err)
+	}
+	configs, err := file.Configs()
+	if err != nil {
+		t.Fatalf("Configs failed: %v", err)
+	}
+	if method := configs["oncall"].SendMethod; method != types.MethodWebClient {
+		t.Errorf("Expected send_method to default to webclient, got %q", method)
+	}
+
+	var cfgErr *types.ConfigError
+	cfg := types.Config{Provider: "slack", Token: "xoxb-test"}
+	if !errors.As(cfg.Validate(), &cfgErr) || fmt.Sprint(cfgErr.Missing) != "[SendMethod]" {
+		t.Errorf("Expected Validate to report the missing send method, got %v", cfgErr)
+	}
+}
+
+func TestConfigFromEnvValidates(t *testing.T) {
+	t.Setenv("ALERTS_PROVIDER", "slack")
+	t.Setenv("ALERTS_TOKEN", "https://hooks.slack.com/services/T/B/X")
+	t.Setenv("ALERTS_LARK_APP_ID", "cli_a1")
+
+	_, err := ConfigFromEnv("ALERTS")
+	var cfgErr *types.ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Expected a *types.ConfigError, got %v", err)
+	}
+	if fmt.Sprint(cfgErr.Missing) != "[ALERTS_LARK_APP_SECRET]" {
+		t.Errorf("Unexpected missing keys %v", cfgErr.Missing)
+	}
+	if len(cfgErr.Invalid) != 1 || !strings.HasPrefix(cfgErr.Invalid[0], "ALERTS_TOKEN: ") {
+		t.Errorf("Expected a webhook URL with webclient to be invalid, got %v", cfgErr.Invalid)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := types.Config{Provider: "slack", SendMethod: types.MethodWebhook, Token: "https://hooks.slack.com/services/T/B/X"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+	invalid := types.Config{
+		Provider:        "lark",
+		RedisHost:       "redis",
+		RateLimitPolicy: "panic",
+		CircuitBreaker:  types.CircuitBreakerConfig{Failover: &types.Config{Provider: "generic"}},
+	}
+	var cfgErr *types.ConfigError
+	if !errors.As(invalid.Validate(), &cfgErr) {
+		t.Fatal("Expected a *types.ConfigError")
+	}
+	want := "[SendMethod Token or LarkToken.AppID and LarkToken.AppSecret RedisPort CircuitBreaker.Failover.Token]"
+	if fmt.Sprint(cfgErr.Missing) != want || len(cfgErr.Invalid) != 1 {
+		t.Errorf("Unexpected problems %+v", cfgErr)
+	}
+}
+
+func TestSlogHandlerUsesRecordContext(t *testing.T) {
+	server, payloads := newCaptureGeneric(t)
+	defer server.Close()
+	var sink bytes.Buffer
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, LocalSink: NewWriterSink(&sink)})
+	defer logger.Close()
+	slogger := slog.New(NewSlogHandler(logger, nil))
+
+	// Errors are typically logged after the request's deadline has passed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	slogger.ErrorContext(ctx, "upstream timed out")
+	slogger.ErrorContext(context.Background(), "payment failed")
+
+	// Alerts passed to DeliverAsync with a done context are refused, but still recorded locally
+	if logger.DeliverAsync(ctx, &types.Alert{Level: types.ERROR, Message: "refused"}, "") {
+		t.Error("Expected DeliverAsync to refuse a done context")
+	}
+	logger.Close()
+	if got := payloads(); len(got) != 2 || got[0]["message"] != "upstream timed out" || got[1]["message"] != "payment failed" {
+		t.Errorf("Expected both records to alert, got %v", got)
+	}
+	if !strings.Contains(sink.String(), "refused") || !strings.Contains(sink.String(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Expected the refused alert in the local sink, got %q", sink.String())
+	}
+}
+
+func TestSlogHandlerDoesNotWaitForDelivery(t *testing.T) {
+	release := make(chan struct{})
+	var delivered int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer server.Close()
+	var sink bytes.Buffer
+	logger := NewLogger(types.Config{Provider: "generic", Token: server.URL, AsyncQueueSize: 1, LocalSink: NewWriterSink(&sink)})
+	slogger := slog.New(NewSlogHandler(logger, nil))
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			slogger.Error("payment failed", "attempt", i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected log calls to return while delivery is blocked")
+	}
+	close(release)
+	logger.Close()
+
+	if n := atomic.LoadInt32(&delivered); n < 1 || n > 2 {
+		t.Errorf("Expected the queued alerts only, got %d deliveries", n)
+	}
+	if !strings.Contains(sink.String(), ErrQueueFull.Error()) {
+		t.Errorf("Expected dropped alerts in the local sink, got %q", sink.String())
+	}
+}
+
+func TestSlackSplitsLongBodies(t *testing.T) {
+	var payload struct {
+		Attachments []struct {
+			Blocks []struct {
+				Text struct {
+					Text string `json:"text"`
+				} `json:"text"`
+			} `json:"blocks"`
+		} `json:"attachments"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+	logger := NewLogger(types.Config{
+		Provider:   "slack",
+		SendMethod: types.MethodWebhook,
+		Token:      server.URL,
+		LocalSink:  NewWriterSink(io.Discard),
+	})
+	defer logger.Close()
+
+	message := "goroutine dump:\n```\n" + strings.Repeat("ünïcødé frame at main.go:42\n", 6000) + "```\nend"
+	if err := logger.Send(types.FATAL, message, nil, ""); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	blocks := payload.Attachments[0].Blocks
+	if len(blocks) != 20 || !strings.Contains(blocks[19].Text.Text, "truncated") {
+		t.Fatalf("Expected 20 blocks ending with a truncation note, got %d", len(blocks))
+	}
+	for i, block := range blocks {
+		text := block.Text.Text
+		if len(text) > 3000 || !utf8.ValidString(text) || strings.ContainsRune(text, utf8.RuneError) {
+			t.Errorf("Block %d is not valid section text (%d bytes)", i, len(text))
+		}
+		if i < 19 && strings.Count(text, "```")%2 != 0 {
+			t.Errorf("Block %d leaves a code block open: %q", i, text[len(text)-20:])
+		}
+	}
+}